@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/philschleier/apiproxy-manifest/manifest"
+)
+
+// auditMain runs the audit subcommand: it checks the manifest shipped with a
+// bundle against the files next to it, without writing anything. It exits
+// with 1 when they don't match and 2 on errors.
+func auditMain(args []string) {
+	fset := flag.NewFlagSet("audit", flag.ExitOnError)
+	hashFlag := fset.String("hash", defaultHash(), hashUsage)
+	normalizeEOL := fset.Bool("normalize-eol", false, "hash CRLF line endings as LF in "+strings.Join(manifest.TextExtensions, ", ")+" files")
+	canonicalXML := fset.Bool("canonical-xml", false, "hash .xml files with sorted attributes and without insignificant whitespace")
+	digestEncoding := fset.String("digest-encoding", "hex", "encoding of digests in version strings: hex or base64")
+	hashPrefix := fset.String("hash-prefix", "", "hash this `string` in front of every file, as with the main command")
+	versionTemplate := fset.String("version-template", "", "text/template for version strings, as with the main command")
+	hashPath := fset.Bool("hash-path", false, "hash the resourceName of every file in front of its content, as with the main command")
+	var exclude stringList
+	fset.Var(&exclude, "exclude", "glob `pattern` of file names to leave out (repeatable)")
+	fset.Usage = func() {
+		out := fset.Output()
+		fmt.Fprintf(out, "Usage: %s audit [options] <bundle>...\n\n", os.Args[0])
+		fmt.Fprintln(out, "Recomputes the version of every file of each bundle and prints the entries")
+		fmt.Fprintln(out, "of manifests/manifest.xml that don't match, as well as files missing from")
+		fmt.Fprintln(out, "the manifest or from the bundle. Each bundle is a folder or a zip archive.")
+		fmt.Fprintln(out, "Options not given are taken from the config file of each bundle. Nothing is")
+		fmt.Fprintln(out, "written. Exits with 1 if any bundle doesn't match its manifest.")
+		fmt.Fprintln(out, "\nOptions:")
+		fset.PrintDefaults()
+	}
+	_ = fset.Parse(args)
+	checkHashEnv(fset)
+	if fset.NArg() == 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	logger = level.NewFilter(logger, level.AllowError())
+
+	opts := manifest.Options{Hash: *hashFlag, DigestEncoding: *digestEncoding, HashPrefix: *hashPrefix, VersionTemplate: *versionTemplate, HashPath: *hashPath, NormalizeEOL: *normalizeEOL, CanonicalXML: *canonicalXML, Exclude: exclude, Logger: logger}
+	if err := opts.Validate(); err != nil {
+		_ = level.Error(logger).Log("message", err)
+		os.Exit(2)
+	}
+	mismatch := false
+	for _, target := range fset.Args() {
+		changes, err := audit(context.Background(), fset, target, opts)
+		if err != nil {
+			_ = level.Error(logger).Log("err", err, "bundle", target)
+			os.Exit(2)
+		}
+		if err := writeAudit(os.Stdout, target, changes); err != nil {
+			_ = level.Error(logger).Log("err", err)
+			os.Exit(2)
+		}
+		mismatch = mismatch || len(changes) > 0
+	}
+	if mismatch {
+		os.Exit(1)
+	}
+}
+
+// audit returns the differences between the manifest recorded in the bundle
+// folder or zip archive target and the manifest of its files. Old holds the
+// recorded version and New the computed one.
+func audit(ctx context.Context, fset *flag.FlagSet, target string, opts manifest.Options) ([]manifest.Change, error) {
+	doc, data, err := readBundle(ctx, fset, target, "manifests/manifest.xml", opts)
+	if err != nil {
+		return nil, err
+	}
+	var recorded manifest.Manifest
+	if err := xml.Unmarshal(data, &recorded); err != nil {
+		return nil, fmt.Errorf("%s: manifests/manifest.xml: %w", target, err)
+	}
+	return manifest.Compare(&recorded, doc), nil
+}
+
+// writeAudit writes one line per change of the bundle target: entries whose
+// recorded version is wrong, files the manifest doesn't list and entries
+// without a file.
+func writeAudit(w io.Writer, target string, changes []manifest.Change) error {
+	for _, c := range changes {
+		var err error
+		switch {
+		case c.Old == "":
+			_, err = fmt.Fprintf(w, "%s: %s %s: not in the manifest\n", target, c.Section, c.ResourceName)
+		case c.New == "":
+			_, err = fmt.Fprintf(w, "%s: %s %s: no such file, recorded %s\n", target, c.Section, c.ResourceName, c.Old)
+		default:
+			_, err = fmt.Fprintf(w, "%s: %s %s: recorded %s, actual %s\n", target, c.Section, c.ResourceName, c.Old, c.New)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/philschleier/apiproxy-manifest/manifest"
+)
+
+// configFile is looked up in the bundle folder when -config is not given.
+const configFile = ".apiproxy-manifest.json"
+
+// config is the content of a config file. Every field is optional.
+type config struct {
+	Hash            string            `json:"hash"`
+	DigestEncoding  string            `json:"digestEncoding"`
+	HashPrefix      string            `json:"hashPrefix"`
+	HashPath        bool              `json:"hashPath"`
+	VersionTemplate string            `json:"versionTemplate"`
+	Jobs            int               `json:"jobs"`
+	ReadRetries     int               `json:"readRetries"`
+	NormalizeEOL    bool              `json:"normalizeEOL"`
+	CanonicalXML    bool              `json:"canonicalXML"`
+	FollowSymlinks  bool              `json:"followSymlinks"`
+	VerifySidecars  bool              `json:"verifySidecars"`
+	NaturalSort     bool              `json:"naturalSort"`
+	FailOnZeroByte  bool              `json:"failOnZeroByte"`
+	MaxFileSize     int64             `json:"maxFileSize"`
+	FailFast        bool              `json:"failFast"`
+	StrictXML       bool              `json:"strictXML"`
+	IncludeSize     bool              `json:"includeSize"`
+	Exclude         []string          `json:"exclude"`
+	ResourceExts    []string          `json:"resourceExtensions"`
+	ResourceMap     map[string]string `json:"resourceMap"`
+	ResourceRoots   []string          `json:"resourceRoots"`
+	PoliciesDir     string            `json:"policiesDir"`
+	ProxiesDir      string            `json:"proxiesDir"`
+	TargetsDir      string            `json:"targetsDir"`
+	ResourcesDir    string            `json:"resourcesDir"`
+	SharedFlowsDir  string            `json:"sharedFlowsDir"`
+}
+
+// loadConfig reads the options from the file given with -config or, if name
+// is empty, from the config file in the bundle folder. A missing config file
+// in the bundle folder is not an error.
+func loadConfig(src source, name string) (manifest.Options, error) {
+	var data []byte
+	var err error
+	if name != "" {
+		data, err = ioutil.ReadFile(name)
+	} else {
+		name = src.Path(configFile)
+		data, err = src.ReadFile(configFile)
+		if os.IsNotExist(err) {
+			return manifest.Options{}, nil
+		}
+	}
+	if err != nil {
+		return manifest.Options{}, err
+	}
+
+	var c config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return manifest.Options{}, fmt.Errorf("%s: %w", name, err)
+	}
+	return manifest.Options{
+		Hash:            c.Hash,
+		DigestEncoding:  c.DigestEncoding,
+		HashPrefix:      c.HashPrefix,
+		HashPath:        c.HashPath,
+		VersionTemplate: c.VersionTemplate,
+		Jobs:            c.Jobs,
+		ReadRetries:     c.ReadRetries,
+		NormalizeEOL:    c.NormalizeEOL,
+		CanonicalXML:    c.CanonicalXML,
+		FollowSymlinks:  c.FollowSymlinks,
+		VerifySidecars:  c.VerifySidecars,
+		NaturalSort:     c.NaturalSort,
+		FailOnZeroByte:  c.FailOnZeroByte,
+		MaxFileSize:     c.MaxFileSize,
+		FailFast:        c.FailFast,
+		StrictXML:       c.StrictXML,
+		IncludeSize:     c.IncludeSize,
+		Exclude:         c.Exclude,
+		ResourceExts:    c.ResourceExts,
+		ResourceMap:     c.ResourceMap,
+		ResourceRoots:   c.ResourceRoots,
+		PoliciesDir:     c.PoliciesDir,
+		ProxiesDir:      c.ProxiesDir,
+		TargetsDir:      c.TargetsDir,
+		ResourcesDir:    c.ResourcesDir,
+		SharedFlowsDir:  c.SharedFlowsDir,
+	}, nil
+}
+
+// withFlags returns the options from a config file with the settings given
+// explicitly in fset, taken from cli, applied on top. Flags fset doesn't
+// define leave the config file alone.
+func withFlags(fset *flag.FlagSet, file, cli manifest.Options) manifest.Options {
+	isSet := func(name string) bool { return isSetIn(fset, name) }
+	if isSet("name") {
+		file.Name = cli.Name
+	}
+	// Without a hash in the config file, the default of -hash applies, which
+	// may come from the environment.
+	if isSet("hash") || file.Hash == "" {
+		file.Hash = cli.Hash
+	}
+	if isSet("digest-encoding") {
+		file.DigestEncoding = cli.DigestEncoding
+	}
+	if isSet("hash-prefix") {
+		file.HashPrefix = cli.HashPrefix
+	}
+	if isSet("hash-path") {
+		file.HashPath = cli.HashPath
+	}
+	if isSet("version-template") {
+		file.VersionTemplate = cli.VersionTemplate
+	}
+	if isSet("jobs") {
+		file.Jobs = cli.Jobs
+	}
+	if isSet("read-retries") {
+		file.ReadRetries = cli.ReadRetries
+	}
+	if isSet("read-buffer") {
+		file.ReadBuffer = cli.ReadBuffer
+	}
+	if isSet("normalize-eol") {
+		file.NormalizeEOL = cli.NormalizeEOL
+	}
+	if isSet("canonical-xml") {
+		file.CanonicalXML = cli.CanonicalXML
+	}
+	if isSet("follow-symlinks") {
+		file.FollowSymlinks = cli.FollowSymlinks
+	}
+	if isSet("verify-sidecars") {
+		file.VerifySidecars = cli.VerifySidecars
+	}
+	if isSet("natural-sort") {
+		file.NaturalSort = cli.NaturalSort
+	}
+	if isSet("fail-on-zero-byte") {
+		file.FailOnZeroByte = cli.FailOnZeroByte
+	}
+	if isSet("max-file-size") {
+		file.MaxFileSize = cli.MaxFileSize
+	}
+	if isSet("fail-fast") {
+		file.FailFast = cli.FailFast
+	}
+	if isSet("strict-xml") {
+		file.StrictXML = cli.StrictXML
+	}
+	if isSet("include-size") {
+		file.IncludeSize = cli.IncludeSize
+	}
+	if isSet("exclude") {
+		file.Exclude = cli.Exclude
+	}
+	if isSet("resource-ext") {
+		file.ResourceExts = cli.ResourceExts
+	}
+	if isSet("resource-map") {
+		file.ResourceMap = cli.ResourceMap
+	}
+	if isSet("resource-root") {
+		file.ResourceRoots = cli.ResourceRoots
+	}
+	file.Logger = cli.Logger
+	file.Progress = cli.Progress
+	return file
+}
+
+// isSetIn reports whether the named flag was given in fset.
+func isSetIn(fset *flag.FlagSet, name string) bool {
+	set := false
+	fset.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
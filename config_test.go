@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/philschleier/apiproxy-manifest/manifest"
+)
+
+// TestWithFlags checks that flags given on the command line override the
+// config file, and that the config file wins over flags left at their
+// defaults.
+func TestWithFlags(t *testing.T) {
+	fset := flag.NewFlagSet("test", flag.ContinueOnError)
+	fset.SetOutput(ioutil.Discard)
+	hash := fset.String("hash", "sha512", "")
+	jobs := fset.Int("jobs", 0, "")
+	readBuffer := fset.Int("read-buffer", 0, "")
+	normalizeEOL := fset.Bool("normalize-eol", false, "")
+	digestEncoding := fset.String("digest-encoding", "hex", "")
+	if err := fset.Parse([]string{"-jobs", "2", "-read-buffer", "4096", "-normalize-eol=false"}); err != nil {
+		t.Fatal(err)
+	}
+	logger := log.NewNopLogger()
+	cli := manifest.Options{Hash: *hash, Jobs: *jobs, ReadBuffer: *readBuffer, NormalizeEOL: *normalizeEOL, DigestEncoding: *digestEncoding, Logger: logger}
+	file := manifest.Options{Hash: "sha256", Jobs: 8, ReadBuffer: 1 << 20, NormalizeEOL: true, DigestEncoding: "base64"}
+
+	got := withFlags(fset, file, cli)
+	want := manifest.Options{Hash: "sha256", Jobs: 2, ReadBuffer: 4096, NormalizeEOL: false, DigestEncoding: "base64", Logger: logger}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("withFlags = %+v, want %+v", got, want)
+	}
+}
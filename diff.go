@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/philschleier/apiproxy-manifest/manifest"
+)
+
+// diffMain runs the diff subcommand: it generates the manifests of two
+// bundles and prints the entries that differ. Like diff(1) it exits with 1
+// when there are differences and 2 on errors.
+func diffMain(args []string) {
+	fset := flag.NewFlagSet("diff", flag.ExitOnError)
+	hashFlag := fset.String("hash", defaultHash(), hashUsage)
+	normalizeEOL := fset.Bool("normalize-eol", false, "hash CRLF line endings as LF in "+strings.Join(manifest.TextExtensions, ", ")+" files")
+	canonicalXML := fset.Bool("canonical-xml", false, "hash .xml files with sorted attributes and without insignificant whitespace")
+	digestEncoding := fset.String("digest-encoding", "hex", "encoding of digests in version strings: hex or base64")
+	hashPrefix := fset.String("hash-prefix", "", "hash this `string` in front of every file, as with the main command")
+	versionTemplate := fset.String("version-template", "", "text/template for version strings, as with the main command")
+	hashPath := fset.Bool("hash-path", false, "hash the resourceName of every file in front of its content, as with the main command")
+	var exclude stringList
+	fset.Var(&exclude, "exclude", "glob `pattern` of file names to leave out (repeatable)")
+	fset.Usage = func() {
+		out := fset.Output()
+		fmt.Fprintf(out, "Usage: %s diff [options] <bundleA> <bundleB>\n\n", os.Args[0])
+		fmt.Fprintln(out, "Prints the resources that were added, removed or changed going from bundleA")
+		fmt.Fprintln(out, "to bundleB, by section. Each bundle is a folder or a zip archive. Nothing")
+		fmt.Fprintln(out, "is written. Options not given are taken from the config file of each bundle.")
+		fmt.Fprintln(out, "Exits with 1 if the bundles differ.")
+		fmt.Fprintln(out, "\nOptions:")
+		fset.PrintDefaults()
+	}
+	_ = fset.Parse(args)
+	checkHashEnv(fset)
+	if fset.NArg() != 2 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	logger = level.NewFilter(logger, level.AllowError())
+
+	opts := manifest.Options{Hash: *hashFlag, DigestEncoding: *digestEncoding, HashPrefix: *hashPrefix, VersionTemplate: *versionTemplate, HashPath: *hashPath, NormalizeEOL: *normalizeEOL, CanonicalXML: *canonicalXML, Exclude: exclude, Logger: logger}
+	if err := opts.Validate(); err != nil {
+		_ = level.Error(logger).Log("message", err)
+		os.Exit(2)
+	}
+	var docs [2]*manifest.Manifest
+	for i, target := range fset.Args() {
+		doc, err := generate(context.Background(), fset, target, opts)
+		if err != nil {
+			_ = level.Error(logger).Log("err", err, "bundle", target)
+			os.Exit(2)
+		}
+		docs[i] = doc
+	}
+	changes := manifest.Compare(docs[0], docs[1])
+	if err := writeDiff(os.Stdout, fset.Arg(0), fset.Arg(1), changes); err != nil {
+		_ = level.Error(logger).Log("err", err)
+		os.Exit(2)
+	}
+	if len(changes) > 0 {
+		os.Exit(1)
+	}
+}
+
+// generate returns the manifest of a bundle folder or zip archive without
+// touching it. See readBundle.
+func generate(ctx context.Context, fset *flag.FlagSet, target string, opts manifest.Options) (*manifest.Manifest, error) {
+	doc, _, err := readBundle(ctx, fset, target, "", opts)
+	return doc, err
+}
+
+// readBundle generates the manifest of a bundle folder or zip archive with
+// the options from its config file, overridden by the flags given in fset,
+// and returns it together with the content of the bundle file name, if name
+// is not empty. Nothing is written.
+func readBundle(ctx context.Context, fset *flag.FlagSet, target, name string, opts manifest.Options) (*manifest.Manifest, []byte, error) {
+	var src source
+	if strings.HasSuffix(target, ".zip") {
+		z, err := openZip(target, "", "", logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer z.Close()
+		src = z
+	} else {
+		src = folderSource{folder: bundleFolder(logger, target, ""), logger: logger}
+	}
+	var data []byte
+	if name != "" {
+		var err error
+		if data, err = src.ReadFile(name); err != nil {
+			return nil, nil, err
+		}
+	}
+	base, err := loadConfig(src, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	opts = withFlags(fset, base, opts)
+	if err := opts.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", src.Path(configFile), err)
+	}
+	doc, err := src.Generate(ctx, opts)
+	return doc, data, err
+}
+
+// writeDiff writes changes in the style of a unified diff: a header naming
+// both bundles, then per section a hunk with the entries from a prefixed by
+// - and those from b prefixed by +.
+func writeDiff(w io.Writer, a, b string, changes []manifest.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "--- %s\n+++ %s\n", a, b); err != nil {
+		return err
+	}
+	section := ""
+	for _, c := range changes {
+		if c.Section != section {
+			section = c.Section
+			if _, err := fmt.Fprintf(w, "@@ %s @@\n", section); err != nil {
+				return err
+			}
+		}
+		if c.Old != "" {
+			if _, err := fmt.Fprintf(w, "-%s %s\n", c.ResourceName, c.Old); err != nil {
+				return err
+			}
+		}
+		if c.New != "" {
+			if _, err := fmt.Fprintf(w, "+%s %s\n", c.ResourceName, c.New); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/philschleier/apiproxy-manifest/manifest"
+)
+
+// hashMain runs the hash subcommand: it prints the version string the
+// manifest would record for one file, read from a named file or stdin.
+func hashMain(args []string) {
+	fset := flag.NewFlagSet("hash", flag.ExitOnError)
+	hashFlag := fset.String("hash", defaultHash(), hashUsage)
+	normalizeEOL := fset.Bool("normalize-eol", false, "hash CRLF line endings as LF in "+strings.Join(manifest.TextExtensions, ", ")+" files")
+	canonicalXML := fset.Bool("canonical-xml", false, "hash .xml files with sorted attributes and without insignificant whitespace")
+	digestEncoding := fset.String("digest-encoding", "hex", "encoding of the digest: hex or base64")
+	hashPrefix := fset.String("hash-prefix", "", "hash this `string` in front of the content, as with the main command")
+	versionTemplate := fset.String("version-template", "", "text/template for the version string, as with the main command")
+	hashPath := fset.Bool("hash-path", false, "hash the resourceName given with -resource-name in front of the content, as with the main command")
+	resourceName := fset.String("resource-name", "", "`resourceName` of the manifest entry, such as AM-1 or jsc://lib/util.js, for -hash-path")
+	name := fset.String("name", "", "file `name` whose extension selects the normalization of stdin")
+	fset.Usage = func() {
+		out := fset.Output()
+		fmt.Fprintf(out, "Usage: %s hash [options] [file]\n\n", os.Args[0])
+		fmt.Fprintln(out, "Prints the version string, e.g. SHA-512:<hex digest>, that a manifest entry")
+		fmt.Fprintln(out, "for the file would get. Without a file, stdin is hashed.")
+		fmt.Fprintln(out, "\nOptions:")
+		fset.PrintDefaults()
+	}
+	_ = fset.Parse(args)
+	checkHashEnv(fset)
+	if fset.NArg() > 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	if *hashPath && *resourceName == "" {
+		_ = level.Error(logger).Log("message", "-hash-path needs -resource-name")
+		os.Exit(2)
+	}
+
+	opts := manifest.Options{Hash: *hashFlag, DigestEncoding: *digestEncoding, HashPrefix: *hashPrefix, VersionTemplate: *versionTemplate, HashPath: *hashPath, NormalizeEOL: *normalizeEOL, CanonicalXML: *canonicalXML}
+	if err := opts.Validate(); err != nil {
+		_ = level.Error(logger).Log("message", err)
+		os.Exit(2)
+	}
+	var r io.Reader = os.Stdin
+	filename := *name
+	if fset.NArg() == 1 {
+		f, err := os.Open(fset.Arg(0))
+		if err != nil {
+			_ = level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		r = f
+		if filename == "" {
+			filename = fset.Arg(0)
+		}
+	}
+	version, err := manifest.ResourceVersion(r, filename, *resourceName, opts)
+	if err != nil {
+		_ = level.Error(logger).Log("err", err)
+		os.Exit(1)
+	}
+	fmt.Println(version)
+}
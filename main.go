@@ -1,272 +1,1141 @@
 package main
 
 import (
-	"crypto/sha512"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"encoding/xml"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
-	"regexp"
-	"sort"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/philschleier/apiproxy-manifest/manifest"
 )
 
 var logger log.Logger
 
+// version is the version of the tool, set at build time with
+// -ldflags "-X main.version=v1.2.3".
+var version string
+
+// toolVersion returns version or, if that wasn't set, the module version
+// recorded by go install.
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
 func init() {
 	w := log.NewSyncWriter(os.Stderr)
 	logger = log.NewLogfmtLogger(w)
 }
 
+// options holds the command line settings that influence a run.
+type options struct {
+	manifest.Options
+	verify   bool
+	validate bool
+	strict   bool
+	stdout   bool
+	dryRun   bool
+	format   string
+	noCache  bool
+	bump     bool
+	stamp    bool
+	by       string
+	printVer bool
+	printFP  bool
+	nonEmpty bool
+	gzip     bool
+	list     bool
+	compare  string
+	layout   manifest.Format
+	dir      string
+	file     string // base name of the manifest, empty for the default
+	comment  bool
+	patch    bool
+	force    bool
+	now      time.Time // fixed time for reproducible output, zero for the clock
+	basepath []string
+	report   string
+	out      io.Writer // where -stdout, -list and the like print
+}
+
 func main() {
-	if len(os.Args) != 2 {
-		_ = logger.Log("message", "please give exactly one argument (apiproxy folder)")
-		return
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			serveMain(os.Args[2:])
+			return
+		case "hash":
+			hashMain(os.Args[2:])
+			return
+		case "diff":
+			diffMain(os.Args[2:])
+			return
+		case "audit":
+			auditMain(os.Args[2:])
+			return
+		}
 	}
-	folder := os.Args[1]
-	if p := strings.Split(folder, "/"); p[len(p)-1] != "apiproxy" {
-		p = append(p, "apiproxy")
-		folder = strings.Join(p, "/")
-		_ = logger.Log("message", "adding suffix /apiproxy")
+	name := flag.String("name", "", "name attribute of the manifest (default: the name of the proxy, manifest for shared flows)")
+	hashFlag := flag.String("hash", defaultHash(), hashUsage)
+	digestEncoding := flag.String("digest-encoding", "hex", "encoding of digests in version strings: hex or base64")
+	hashPrefix := flag.String("hash-prefix", "", "hash this `string` in front of every file and the manifest, for namespaced digests that don't match plain ones")
+	hashPath := flag.Bool("hash-path", false, "hash the resourceName of every file in front of its content, so moving a file changes its version")
+	versionTemplate := flag.String("version-template", "", "text/template for version strings, with .Algo, .Hash and .Digest (default \"{{.Algo}}:{{.Digest}}\")")
+	jobs := flag.Int("jobs", runtime.NumCPU(), "number of files hashed concurrently")
+	readBuffer := flag.Int("read-buffer", 0, "size in `bytes` of the buffer files are hashed through (default 65536)")
+	readRetries := flag.Int("read-retries", 0, "retry a failed file read this many times, with a growing delay, before giving up")
+	verifyOnly := flag.Bool("verify", false, "check the existing manifest instead of rewriting it")
+	validate := flag.Bool("validate", false, "check that every policy, endpoint and resource named in the proxy file exists")
+	strict := flag.Bool("strict", false, "treat an unsupported ConfigurationVersion and, with -validate, files not listed in the proxy file as errors")
+	toStdout := flag.Bool("stdout", false, "write the manifest to stdout and leave the bundle untouched")
+	outputDir := flag.String("output-dir", "", "write the manifest and proxy file below this `directory` instead of the bundle folder")
+	printVersion := flag.Bool("print-version-only", false, "print the ManifestVersion to stdout and nothing else, without writing any files")
+	manifestName := flag.String("manifest-name", "", "base `name` of the manifest file in manifests/ (default: manifest.xml, or manifest.json with -format json)")
+	gzipFlag := flag.Bool("gzip", false, "write the manifest gzipped, as manifests/manifest.xml.gz (or manifest.json.gz)")
+	failOnEmpty := flag.Bool("fail-on-empty", false, "fail if no policies, proxy endpoints or resources were found, which usually means a wrong folder")
+	list := flag.Bool("list", false, "print the section, resource name and digest of every file to stdout (as JSON with -format json) and write nothing")
+	fingerprint := flag.Bool("fingerprint", false, "print a digest over all file digests to stdout and nothing else, without writing any files")
+	compareTo := flag.String("compare-to", "", "log the entries added, removed or changed since the manifest in this `file`")
+	declaration := flag.String("xml-declaration", "default", "XML declaration of the manifest and proxy file: default, no-standalone or none")
+	noComment := flag.Bool("no-comment", false, "leave out the comment naming the tool version and hash algorithm at the top of the manifest")
+	fullRewrite := flag.Bool("full-rewrite", false, "serialize the proxy file from scratch instead of replacing only the changed elements")
+	sortAttributes := flag.Bool("sort-attributes", false, "write the attributes of every element in alphabetical order")
+	includeEmpty := flag.Bool("include-empty-sections", true, "write manifest sections without entries as empty elements; -include-empty-sections=false leaves them out")
+	indent := flag.String("indent", "4", "indentation of the manifest and a rewritten proxy file: a number of spaces or tab")
+	emptyTags := flag.String("empty-tags", "self-closing", "how empty elements are written: self-closing (<a/>) or expanded (<a></a>)")
+	reportFile := flag.String("report", "", "write a JSON summary of the run to this `file`, also with -dry-run")
+	patch := flag.Bool("patch", false, "print the changes to the manifest and proxy file as a unified diff for git apply instead of writing them")
+	dryRun := flag.Bool("dry-run", false, "compute everything but only log what would be written")
+	format := flag.String("format", "xml", "manifest output format: xml or json (json is written to manifests/manifest.json)")
+	includeSize := flag.Bool("include-size", false, "add the size of every file as a size attribute to its manifest entry")
+	strictXML := flag.Bool("strict-xml", false, "fail if an XML file in policies, proxies, targets or sharedflows is not well-formed")
+	failFast := flag.Bool("fail-fast", false, "stop at the first problem instead of reporting the problems of all sections together")
+	maxFileSize := flag.Int64("max-file-size", 0, "fail if a file in the bundle is larger than this many `bytes` (default: no limit)")
+	failOnZeroByte := flag.Bool("fail-on-zero-byte", false, "fail if a file in the bundle is empty instead of only warning")
+	naturalSort := flag.Bool("natural-sort", false, "order resource names with embedded numbers numerically (policy-2 before policy-10)")
+	var basepaths stringList
+	flag.Var(&basepaths, "basepath", "replace the basepaths of the proxy with this `path` (repeatable)")
+	var resourceMap stringList
+	flag.Var(&resourceMap, "resource-map", "use `dir=scheme` as the scheme of resources in resources/dir (repeatable)")
+	var exclude stringList
+	flag.Var(&exclude, "exclude", "glob `pattern` of file names to leave out of the manifest (repeatable)")
+	var resourceRoots stringList
+	flag.Var(&resourceRoots, "resource-root", "also collect resources from this `directory`, relative to the bundle folder (repeatable)")
+	var resourceExts stringList
+	flag.Var(&resourceExts, "resource-ext", "only include resource files with this `extension`, e.g. js (repeatable; default: all)")
+	normalizeEOL := flag.Bool("normalize-eol", false, "hash CRLF line endings as LF in "+strings.Join(manifest.TextExtensions, ", ")+" files")
+	canonicalXML := flag.Bool("canonical-xml", false, "hash .xml files with sorted attributes and without insignificant whitespace (changes all their digests)")
+	followSymlinks := flag.Bool("follow-symlinks", false, "hash the targets of symlinks in resource directories instead of skipping them")
+	verifySidecars := flag.Bool("verify-sidecars", false, "fail if a resource file doesn't match the digest in its <name>.sha512 sidecar file")
+	showProgress := flag.Bool("progress", false, "report how many files have been hashed so far")
+	logFormat := flag.String("log-format", "logfmt", "log output format: logfmt or json")
+	quiet := flag.Bool("quiet", false, "only log errors")
+	verbose := flag.Bool("verbose", false, "also log the digest computed for every file")
+	bump := flag.Bool("bump-revision", false, "increment the revision attribute of the proxy file")
+	stamp := flag.Bool("stamp-modified", false, "set LastModifiedAt and LastModifiedBy in the proxy file")
+	force := flag.Bool("force", false, "write the manifest even if the folder doesn't look like a bundle")
+	timestamp := flag.String("timestamp", "", "use this `time`, Unix seconds or RFC 3339, instead of the clock (default: $SOURCE_DATE_EPOCH)")
+	modifiedBy := flag.String("modified-by", "", "`user` recorded by -stamp-modified (default: the current user)")
+	noCache := flag.Bool("no-cache", false, "hash every file instead of reusing cached digests, and leave the cache alone")
+	bundleDir := flag.String("bundle-dir", "", "`name` of the bundle folder when it is neither apiproxy nor sharedflowbundle")
+	bundleJobs := flag.Int("bundle-jobs", 1, "number of bundles generated concurrently when several are given")
+	recursive := flag.String("recursive", "", "process every apiproxy and sharedflowbundle folder below this `directory`")
+	watchFlag := flag.Bool("watch", false, "keep running and regenerate whenever a file in policies, proxies, resources or targets changes")
+	timeout := flag.Duration("timeout", 0, "give up after this long, e.g. 5m (default: no limit)")
+	configPath := flag.String("config", "", "read default options from this `file` instead of "+configFile+" in the bundle folder")
+	flag.Usage = usage
+	flag.Parse()
+	checkHashEnv(flag.CommandLine)
+
+	if *logFormat != "logfmt" && *logFormat != "json" {
+		_ = level.Error(logger).Log("message", "unsupported log format "+*logFormat)
+		os.Exit(2)
 	}
+	// newLogger returns a logger writing to w in the chosen format and level.
+	newLogger := func(w io.Writer) log.Logger {
+		l := log.NewLogfmtLogger(w)
+		if *logFormat == "json" {
+			l = log.NewJSONLogger(w)
+		}
+		switch {
+		case *quiet, *printVersion, *fingerprint, *list:
+			return level.NewFilter(l, level.AllowError())
+		case *verbose:
+			return level.NewFilter(l, level.AllowDebug())
+		}
+		return level.NewFilter(l, level.AllowInfo())
+	}
+	logger = newLogger(log.NewSyncWriter(os.Stderr))
 
-	apiproxyFile, apiproxy, err := findProxyFile(folder)
-	if err != nil {
-		_ = logger.Log("err", err)
-		return
+	if *format != "xml" && *format != "json" {
+		_ = level.Error(logger).Log("message", "unsupported format "+*format)
+		os.Exit(2)
+	}
+	opts := options{
+		Options: manifest.Options{
+			Name:            *name,
+			Hash:            *hashFlag,
+			DigestEncoding:  *digestEncoding,
+			HashPrefix:      *hashPrefix,
+			HashPath:        *hashPath,
+			VersionTemplate: *versionTemplate,
+			Jobs:            *jobs,
+			ReadRetries:     *readRetries,
+			ReadBuffer:      *readBuffer,
+			NormalizeEOL:    *normalizeEOL,
+			CanonicalXML:    *canonicalXML,
+			FollowSymlinks:  *followSymlinks,
+			VerifySidecars:  *verifySidecars,
+			NaturalSort:     *naturalSort,
+			FailOnZeroByte:  *failOnZeroByte,
+			MaxFileSize:     *maxFileSize,
+			FailFast:        *failFast,
+			StrictXML:       *strictXML,
+			IncludeSize:     *includeSize,
+			Exclude:         exclude,
+			ResourceExts:    resourceExts,
+			ResourceRoots:   resourceRoots,
+			Logger:          logger,
+		},
+		verify:   *verifyOnly,
+		validate: *validate,
+		strict:   *strict,
+		stdout:   *toStdout,
+		dryRun:   *dryRun,
+		format:   *format,
+		noCache:  *noCache,
+		bump:     *bump,
+		stamp:    *stamp,
+		by:       *modifiedBy,
+		printVer: *printVersion,
+		printFP:  *fingerprint,
+		nonEmpty: *failOnEmpty,
+		gzip:     *gzipFlag,
+		list:     *list,
+		compare:  *compareTo,
+		basepath: basepaths,
+		report:   *reportFile,
+		out:      os.Stdout,
+		dir:      *bundleDir,
+		file:     *manifestName,
+		force:    *force,
+		comment:  !*noComment,
+		patch:    *patch,
+	}
+	if len(resourceMap) > 0 {
+		opts.ResourceMap = make(map[string]string)
+		for _, m := range resourceMap {
+			dir, scheme := cut(m, "=")
+			if dir == "" || scheme == "" {
+				_ = level.Error(logger).Log("message", "resource map must look like dir=scheme", "resource-map", m)
+				os.Exit(2)
+			}
+			opts.ResourceMap[dir] = scheme
+		}
+	}
+	if *showProgress {
+		opts.Progress = newProgress().update
+	}
+	for _, p := range basepaths {
+		if !strings.HasPrefix(p, "/") {
+			_ = level.Error(logger).Log("message", "basepath must start with /", "basepath", p)
+			os.Exit(2)
+		}
+	}
+	if *patch && (*toStdout || *dryRun || *gzipFlag || *outputDir != "") {
+		_ = level.Error(logger).Log("message", "-patch writes nothing and prints to stdout, it can't be combined with -stdout, -dry-run, -gzip or -output-dir")
+		os.Exit(2)
+	}
+	if *manifestName != "" && (strings.ContainsAny(*manifestName, `/\`) || *manifestName == "." || *manifestName == "..") {
+		_ = level.Error(logger).Log("message", "-manifest-name must be a plain file name, not "+*manifestName)
+		os.Exit(2)
+	}
+	var err error
+	if opts.now, err = fixedTime(*timestamp); err != nil {
+		_ = level.Error(logger).Log("message", err)
+		os.Exit(2)
+	}
+	opts.layout.FullRewrite = *fullRewrite
+	opts.layout.OmitEmpty = !*includeEmpty
+	opts.layout.SortAttrs = *sortAttributes
+	if opts.layout.Declaration, err = manifest.ParseDeclaration(*declaration); err != nil {
+		_ = level.Error(logger).Log("message", err)
+		os.Exit(2)
+	}
+	if opts.layout.Indent, err = manifest.ParseIndent(*indent); err != nil {
+		_ = level.Error(logger).Log("message", err)
+		os.Exit(2)
+	}
+	switch *emptyTags {
+	case "self-closing":
+	case "expanded":
+		opts.layout.ExpandEmpty = true
+	default:
+		_ = level.Error(logger).Log("message", "unsupported empty tag style "+*emptyTags)
+		os.Exit(2)
+	}
+	if err := opts.Validate(); err != nil {
+		_ = level.Error(logger).Log("message", err)
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
 	}
 
-	doc := new(Manifest)
-	doc.Name = "manifest"
-	{
-		dir := folder + "/policies"
-		policies, err := calculateAll(dir, stripSuffix("xml"))
+	targets := flag.Args()
+	// bases holds the directory each target is named relative to in
+	// -output-dir.
+	bases := make([]string, len(targets))
+	for i := range bases {
+		bases[i] = "."
+	}
+	if *recursive != "" {
+		found, err := findBundles(*recursive, *bundleDir)
 		if err != nil {
-			_ = logger.Log("err", err)
-			return
+			_ = level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+		targets = append(targets, found...)
+		for range found {
+			bases = append(bases, *recursive)
 		}
-		doc.Policies.VersionInfo = policies
 	}
-	{
-		dir := folder + "/proxies"
-		proxies, err := calculateAll(dir, stripSuffix("xml"))
-		if err != nil {
-			_ = logger.Log("err", err)
-			return
+	if dir := os.Getenv("APIPROXY_DIR"); len(targets) == 0 && dir != "" {
+		targets = []string{dir}
+		bases = []string{"."}
+	}
+	if len(targets) == 0 {
+		_ = level.Error(logger).Log("message", "please give at least one argument (apiproxy folder) or set APIPROXY_DIR")
+		flag.Usage()
+		os.Exit(2)
+	}
+	outs, err := outputDirs(*outputDir, targets, bases, opts.dir)
+	if err != nil {
+		_ = level.Error(logger).Log("message", err)
+		os.Exit(2)
+	}
+	if *watchFlag {
+		for _, target := range targets {
+			if strings.HasSuffix(target, ".zip") {
+				_ = level.Error(logger).Log("message", "-watch only works with bundle folders, not "+target)
+				os.Exit(2)
+			}
+		}
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		out := make(map[string]string, len(targets))
+		for i, target := range targets {
+			out[target] = outs[i]
 		}
-		doc.ProxyEndpoints.VersionInfo = proxies
+		regenerate := func(target string) error {
+			return process(ctx, target, out[target], *configPath, opts)
+		}
+		for _, target := range targets {
+			if err := regenerate(target); err != nil {
+				_ = level.Error(logger).Log("err", err, "bundle", target)
+			}
+		}
+		watch(ctx, targets, *configPath, opts, regenerate)
+		return
 	}
-	{
-		dir := folder + "/resources"
-		resourceDir, err := ioutil.ReadDir(dir)
-		if err != nil {
-			_ = logger.Log("err", err)
-			return
+	if len(targets) == 1 {
+		if err := process(ctx, targets[0], outs[0], *configPath, opts); err != nil {
+			_ = level.Error(logger).Log("err", err)
+			if errors.Is(err, errOutOfDate) {
+				os.Exit(exitOutOfDate)
+			}
+			os.Exit(1)
 		}
-		for _, d := range resourceDir {
-			resourceDir := dir + "/" + d.Name()
-			resources, err := calculateAll(resourceDir, func(file os.FileInfo) string {
-				return d.Name() + "://" + file.Name()
-			})
-			if err != nil {
-				_ = logger.Log("err", err)
-				return
+		return
+	}
+
+	if *bundleJobs < 1 {
+		_ = level.Error(logger).Log("message", "-bundle-jobs must be at least 1")
+		os.Exit(2)
+	}
+	if *bundleJobs > 1 {
+		opts.Progress = nil
+	}
+	failed, stale := processBundles(ctx, targets, outs, *configPath, *bundleJobs, opts, newLogger, os.Stderr, os.Stdout)
+	_ = level.Info(logger).Log("message", "processed bundles", "ok", len(targets)-len(failed)-len(stale), "outOfDate", len(stale), "failed", len(failed))
+	if len(failed) > 0 {
+		_ = level.Error(logger).Log("message", "some bundles failed", "bundles", strings.Join(failed, ","))
+		os.Exit(1)
+	}
+	if len(stale) > 0 {
+		_ = level.Error(logger).Log("message", "some manifests are out of date", "bundles", strings.Join(stale, ","))
+		os.Exit(exitOutOfDate)
+	}
+}
+
+// processBundles processes targets with up to jobs bundles at a time and
+// returns the targets that failed and those out of date. Every bundle logs
+// through a logger from newLogger and prints into buffers of its own, which
+// are copied to stderr and stdout in the order of targets once the bundle is
+// done, so the output of concurrent bundles doesn't interleave.
+func processBundles(ctx context.Context, targets, outs []string, configPath string, jobs int, opts options, newLogger func(io.Writer) log.Logger, stderr, stdout io.Writer) (failed, stale []string) {
+	errs := make([]error, len(targets))
+	logs := make([]bytes.Buffer, len(targets))
+	prints := make([]bytes.Buffer, len(targets))
+	done := make([]chan struct{}, len(targets))
+	sem := make(chan struct{}, jobs)
+	for i, target := range targets {
+		done[i] = make(chan struct{})
+		go func(i int, target string) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			defer close(done[i])
+			opts := opts
+			// The hash workers of a bundle log concurrently.
+			opts.Logger = log.With(newLogger(log.NewSyncWriter(&logs[i])), "bundle", target)
+			opts.out = &prints[i]
+			if errs[i] = process(ctx, target, outs[i], configPath, opts); errs[i] != nil {
+				_ = level.Error(opts.Logger).Log("err", errs[i])
 			}
-			doc.Resources.VersionInfo = append(doc.Resources.VersionInfo, resources...)
+		}(i, target)
+	}
+	for i, target := range targets {
+		<-done[i]
+		_, _ = logs[i].WriteTo(stderr)
+		_, _ = prints[i].WriteTo(stdout)
+		switch {
+		case errs[i] == nil:
+		case errors.Is(errs[i], errOutOfDate):
+			stale = append(stale, target)
+		default:
+			failed = append(failed, target)
 		}
 	}
+	return failed, stale
+}
 
-	xm, err := marshal(&doc)
-	if err != nil {
-		_ = logger.Log("err", err)
-		return
+// errOutOfDate is returned by -verify when the manifest or ManifestVersion
+// doesn't match the bundle. It exits with exitOutOfDate instead of 1, so CI
+// can tell a stale manifest from a failure of the tool.
+var errOutOfDate = errors.New("manifest is out of date")
+
+const exitOutOfDate = 3
+
+// hashEnv names the environment variable that sets the default of -hash, so
+// CI images can choose the algorithm for every invocation.
+const hashEnv = "APIPROXY_MANIFEST_HASH"
+
+const hashUsage = "digest algorithm: sha512, sha256 or sha384 (default from $" + hashEnv + " if set)"
+
+// defaultHash returns the default of -hash: the value of hashEnv or sha512.
+func defaultHash() string {
+	if h := os.Getenv(hashEnv); h != "" {
+		return h
 	}
+	return "sha512"
+}
 
-	f, err := os.Create(folder + "/manifests/manifest.xml")
-	if err != nil {
-		_ = logger.Log("err", err)
+// checkHashEnv exits if -hash was not given on fset and hashEnv names an
+// unsupported algorithm.
+func checkHashEnv(fset *flag.FlagSet) {
+	h := os.Getenv(hashEnv)
+	if h == "" {
 		return
 	}
-	defer f.Close()
+	set := false
+	fset.Visit(func(f *flag.Flag) {
+		set = set || f.Name == "hash"
+	})
+	if set {
+		return
+	}
+	if err := (manifest.Options{Hash: h}).Validate(); err != nil {
+		_ = level.Error(logger).Log("message", "$"+hashEnv+": "+err.Error())
+		os.Exit(2)
+	}
+}
+
+// process runs one bundle folder or zip archive with the options from its
+// config file, overridden by the command line. The results go to out if that
+// is not empty, see outputDirs.
+func process(ctx context.Context, target, out, configPath string, opts options) error {
+	var src source
+	if strings.HasSuffix(target, ".zip") {
+		if opts.patch {
+			return errors.New(target + ": -patch only works with bundle folders")
+		}
+		z, err := openZip(target, out, opts.dir, opts.Logger)
+		if err != nil {
+			return err
+		}
+		defer z.Close()
+		src = z
+	} else {
+		folder := bundleFolder(opts.Logger, target, opts.dir)
+		src = folderSource{folder: folder, out: out, logger: opts.Logger}
+		if opts.patch {
+			src = patchSource{source: src, w: opts.out}
+		}
+	}
 
-	data := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" + string(xm) + "\n"
-	_, err = f.WriteString(data)
+	base, err := loadConfig(src, configPath)
 	if err != nil {
-		_ = logger.Log("err", err)
-		return
+		return err
+	}
+	opts.Options = withFlags(flag.CommandLine, base, opts.Options)
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	return run(ctx, src, opts)
+}
+
+// outputDirs returns the output directory of each target. With several
+// targets, a bundle folder gets a subdirectory of out named after the path of
+// the folder containing it, relative to its base: the -recursive root, or the
+// working directory for arguments. Two bundles that would share a
+// subdirectory are an error, since one would overwrite the other.
+func outputDirs(out string, targets, bases []string, dir string) ([]string, error) {
+	outs := make([]string, len(targets))
+	for i := range outs {
+		outs[i] = out
+	}
+	if out == "" || len(targets) == 1 {
+		return outs, nil
+	}
+	seen := make(map[string]string)
+	for i, target := range targets {
+		if strings.HasSuffix(target, ".zip") {
+			continue
+		}
+		sub, err := outputSubdir(filepath.Dir(bundleFolder(log.NewNopLogger(), target, dir)), bases[i])
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := seen[sub]; ok {
+			return nil, fmt.Errorf("%s and %s would both be written to %s", other, target, filepath.Join(out, sub))
+		}
+		seen[sub] = target
+		outs[i] = filepath.Join(out, sub)
 	}
-	_ = logger.Log("message", "wrote manifest.xml")
-	msum, err := sum(folder + "/manifests/manifest.xml")
+	return outs, nil
+}
+
+// outputSubdir returns the path of parent relative to base. A parent outside
+// of base is named by its absolute path, and base itself by its name.
+func outputSubdir(parent, base string) (string, error) {
+	parent, err := filepath.Abs(parent)
 	if err != nil {
-		_ = logger.Log("err", err)
-		return
+		return "", err
 	}
-	apiproxy.ManifestVersion = "SHA-512:" + msum
-	xm, err = marshal(&apiproxy)
+	if base, err = filepath.Abs(base); err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(base, parent)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = strings.TrimLeft(strings.TrimPrefix(parent, filepath.VolumeName(parent)), `/\`)
+	}
+	if rel == "." || rel == "" {
+		rel = filepath.Base(parent)
+	}
+	return rel, nil
+}
+
+// findBundles returns every bundle directory below root, as recognized by
+// isBundleDir. Hidden directories are not searched.
+func findBundles(root, dir string) ([]string, error) {
+	var bundles []string
+	err := filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		switch {
+		case isBundleDir(d.Name(), dir):
+			bundles = append(bundles, name)
+			return filepath.SkipDir
+		case name != root && strings.HasPrefix(d.Name(), "."):
+			return filepath.SkipDir
+		}
+		return nil
+	})
 	if err != nil {
-		_ = logger.Log("err", err)
-		return
+		return nil, err
+	}
+	if len(bundles) == 0 {
+		return nil, fmt.Errorf("no apiproxy or sharedflowbundle folder below %s", root)
 	}
-	pf, err := os.Create(apiproxyFile)
+	return bundles, nil
+}
+
+// output is a file to write, relative to the bundle folder.
+type output struct {
+	name string
+	data []byte
+}
+
+func run(ctx context.Context, src source, opts options) error {
+	logger := opts.Logger
+	bundle, err := src.Bundle()
 	if err != nil {
-		_ = logger.Log("err", err)
-		return
+		return err
+	}
+	proxyFile := filepath.Base(bundle.Path)
+	if major, minor := bundle.ConfigurationVersion(); major != "4" {
+		if opts.strict {
+			return fmt.Errorf("%s: unsupported ConfigurationVersion %s.%s", src.Path(proxyFile), major, minor)
+		}
+		_ = level.Warn(logger).Log("message", "unsupported ConfigurationVersion", "majorVersion", major, "minorVersion", minor, "file", src.Path(proxyFile))
+	}
+	cachePath := src.CachePath()
+	if opts.noCache {
+		cachePath = ""
+	}
+	if cachePath != "" {
+		cache, err := manifest.LoadCache(cachePath)
+		if err != nil {
+			_ = level.Warn(logger).Log("message", "ignoring unreadable cache", "file", cachePath, "err", err)
+			cache = manifest.NewCache()
+		}
+		opts.Cache = cache
+	}
+	doc, err := src.Generate(ctx, opts.Options)
+	if errs, ok := err.(manifest.Errors); ok {
+		for _, err := range errs {
+			_ = level.Error(logger).Log("err", err)
+		}
+		return fmt.Errorf("%s: %d problems found", src.Path(""), len(errs))
 	}
-	defer pf.Close()
-	data = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" + string(xm) + "\n"
-	_, err = pf.WriteString(data)
 	if err != nil {
-		_ = logger.Log("err", err)
-		return
+		return err
+	}
+	if opts.nonEmpty && len(doc.Policies.VersionInfo) == 0 && len(doc.ProxyEndpoints.VersionInfo) == 0 && len(doc.Resources.VersionInfo) == 0 {
+		return fmt.Errorf("%s: no policies, proxy endpoints or resources found", src.Path(""))
+	}
+	writes := !opts.verify && !opts.stdout && !opts.dryRun && !opts.printVer && !opts.printFP && !opts.list
+	if writes && !opts.force && !looksLikeBundle(doc) {
+		return fmt.Errorf("%s: no policies, proxy endpoints or shared flows found, not writing into what may not be a bundle (use -force to write anyway)", src.Path(""))
+	}
+	if opts.Cache != nil && writes {
+		if err := opts.Cache.Save(cachePath); err != nil {
+			_ = level.Warn(logger).Log("message", "could not save cache", "file", cachePath, "err", err)
+		}
 	}
-	_ = logger.Log("message", "wrote "+apiproxyFile)
-}
 
-func stripSuffix(suffix string) func(file os.FileInfo) string {
-	suffix = "." + suffix
-	return func(file os.FileInfo) string {
-		return strings.TrimSuffix(file.Name(), suffix)
+	if opts.validate {
+		problems := 0
+		var mapped []string
+		for _, scheme := range opts.ResourceMap {
+			mapped = append(mapped, scheme)
+		}
+		issues := append(manifest.CheckDescriptor(bundle), manifest.Check(bundle, doc)...)
+		issues = append(issues, manifest.CheckResourceTypes(doc, mapped)...)
+		for _, issue := range issues {
+			switch issue.Kind {
+			case manifest.Missing:
+				_ = level.Error(logger).Log("message", "not found on disk", "section", issue.Section, "name", issue.Name, "file", src.Path(proxyFile))
+				problems++
+			case manifest.Orphaned:
+				_ = level.Warn(logger).Log("message", "not listed in proxy file", "section", issue.Section, "name", issue.Name, "file", src.Path(proxyFile))
+				if opts.strict {
+					problems++
+				}
+			case manifest.UnknownType:
+				_ = level.Warn(logger).Log("message", "unknown resource type", "section", issue.Section, "name", issue.Name)
+				if opts.strict {
+					problems++
+				}
+			case manifest.Incomplete:
+				_ = level.Warn(logger).Log("message", "missing in proxy file", "element", issue.Section, "name", issue.Name, "file", src.Path(proxyFile))
+				if opts.strict {
+					problems++
+				}
+			}
+		}
+		if problems > 0 {
+			return fmt.Errorf("validation found %d problems", problems)
+		}
 	}
-}
 
-func calculateAll(dir string, resourceName func(os.FileInfo) string) ([]VersionInfo, error) {
-	files, err := ioutil.ReadDir(dir)
+	if opts.compare != "" {
+		if err := compareTo(logger, opts.compare, doc); err != nil {
+			return err
+		}
+	}
+
+	// ManifestVersion is the digest of exactly the bytes written, comment
+	// included. Plain is the manifest without the comment, which -verify
+	// compares against.
+	var buf bytes.Buffer
+	if err := manifest.WriteManifestFormat(doc, &buf, opts.layout); err != nil {
+		return err
+	}
+	plain := buf.String()
+	if opts.comment {
+		layout := opts.layout
+		layout.Comment = "generated by apiproxy-manifest " + toolVersion() + " using " + manifest.AlgorithmName(opts.Hash)
+		buf.Reset()
+		if err := manifest.WriteManifestFormat(doc, &buf, layout); err != nil {
+			return err
+		}
+	}
+	data := buf.String()
+	manifestVersion, err := manifest.Version(strings.NewReader(data), opts.Options)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	infos := make([]VersionInfo, len(files))
-	resourceNames := make(map[string]string)
-	sorted := make([]string, len(files))
 
-	for i, file := range files {
-		x := resourceName(file)
-		resourceNames[x] = file.Name()
-		sorted[i] = x
+	if opts.report != "" {
+		if err := writeReport(logger, opts.report, bundle, doc, opts.Hash, manifestVersion, opts.time()); err != nil {
+			return err
+		}
 	}
-	sort.Strings(sorted)
-	for i, file := range sorted {
-		filename := resourceNames[file]
-		sha, _ := sum(dir + "/" + filename)
-		infos[i] = VersionInfo{
-			ResourceName: file,
-			Version:      fmt.Sprintf("SHA-512:%s", sha),
+
+	if opts.printVer {
+		_, err := fmt.Fprintln(opts.out, manifestVersion)
+		return err
+	}
+	if opts.list {
+		return list(opts.out, doc, opts.format)
+	}
+	if opts.printFP {
+		fp, err := manifest.Fingerprint(doc, opts.Options)
+		if err != nil {
+			return err
 		}
+		_, err = fmt.Fprintln(opts.out, fp)
+		return err
 	}
-	return infos, nil
-}
 
-func findProxyFile(folder string) (string, *APIProxy, error) {
-	files, err := ioutil.ReadDir(folder)
+	if opts.verify {
+		ok, err := verify(logger, src, doc, plain, opts.manifestFile("xml"), proxyFile, bundle.ManifestVersion(), manifestVersion, opts.Options)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errOutOfDate
+		}
+		_ = level.Info(logger).Log("message", "manifest is up to date")
+		return nil
+	}
+
+	if opts.format == "json" {
+		var js bytes.Buffer
+		if err := manifest.WriteManifestJSON(doc, &js); err != nil {
+			return err
+		}
+		if opts.stdout {
+			if _, err := js.WriteTo(opts.out); err != nil {
+				return err
+			}
+			_ = level.Info(logger).Log("message", "wrote manifest to stdout")
+			return nil
+		}
+		out, err := manifestOutput(opts.manifestFile("json"), js.Bytes(), opts.gzip)
+		if err != nil {
+			return err
+		}
+		if opts.dryRun {
+			_ = level.Info(logger).Log(append([]interface{}{"message", "dry run, not writing", "manifest", src.Target(out.name)}, sectionCounts(doc)...)...)
+			return nil
+		}
+		return save(logger, src, doc, []output{out})
+	}
+
+	if opts.stdout {
+		if _, err := io.WriteString(opts.out, data); err != nil {
+			return err
+		}
+		_ = level.Info(logger).Log("message", "wrote manifest to stdout")
+		return nil
+	}
+
+	out, err := manifestOutput(opts.manifestFile("xml"), []byte(data), opts.gzip)
 	if err != nil {
-		return "", nil, err
+		return err
 	}
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	if opts.dryRun {
+		_ = level.Info(logger).Log(append([]interface{}{"message", "dry run, not writing", "manifest", src.Target(out.name), "proxy", src.Target(proxyFile), "ManifestVersion", manifestVersion}, sectionCounts(doc)...)...)
+		return nil
+	}
+
+	unchanged := bundle.ManifestVersion() == manifestVersion && !opts.bump && !opts.stamp && len(opts.basepath) == 0
+	files := []output{out}
+	if unchanged && src.Target(proxyFile) == src.Path(proxyFile) {
+		_ = level.Info(logger).Log("message", "manifest unchanged", "file", src.Path(proxyFile))
+		return save(logger, src, doc, files)
+	}
+
+	bundle.SetManifestVersion(manifestVersion)
+	if opts.bump {
+		if revision, err := bundle.BumpRevision(); err != nil {
+			_ = level.Error(logger).Log("message", "not bumping revision", "file", src.Path(proxyFile), "err", err)
+		} else {
+			_ = level.Info(logger).Log("message", "bumped revision", "revision", revision)
+		}
+	}
+	if len(opts.basepath) > 0 {
+		if bundle.APIProxy == nil {
+			return errors.New("-basepath only applies to API proxies")
 		}
-		if strings.HasSuffix(file.Name(), ".xml") {
-			path := folder + "/" + file.Name()
-			ok, proxy := checkProxyFile(path)
-			if ok {
-				return path, proxy, nil
+		bundle.APIProxy.Basepaths = opts.basepath
+	}
+	if opts.stamp {
+		by := opts.by
+		if by == "" {
+			u, err := user.Current()
+			if err != nil {
+				return err
 			}
+			by = u.Username
 		}
+		bundle.SetModified(opts.time(), by)
+	}
+	var proxy bytes.Buffer
+	if err := bundle.WriteFormat(&proxy, opts.layout); err != nil {
+		return err
 	}
-	return "", nil, errors.New("didnt find main proxy file")
+	return save(logger, src, doc, append(files, output{proxyFile, proxy.Bytes()}))
 }
 
-func checkProxyFile(path string) (bool, *APIProxy) {
-	c, err := ioutil.ReadFile(path)
-	if err != nil {
-		return false, nil
+// listEntry is one line of -list output.
+type listEntry struct {
+	Section      string `json:"section"`
+	ResourceName string `json:"resourceName"`
+	Version      string `json:"version"`
+}
+
+// list writes every entry of doc to w, as a table or, for format json, as a
+// JSON array.
+func list(w io.Writer, doc *manifest.Manifest, format string) error {
+	entries := []listEntry{}
+	for _, section := range doc.Sections() {
+		for _, v := range section.VersionInfo {
+			entries = append(entries, listEntry{section.Name, v.ResourceName, v.Version})
+		}
 	}
-	var p APIProxy
-	err = xml.Unmarshal(c, &p)
-	if err != nil {
-		return false, nil
+	if format == "json" {
+		js, err := json.MarshalIndent(entries, "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(js, '\n'))
+		return err
 	}
-	return true, &p
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Section, e.ResourceName, e.Version)
+	}
+	return tw.Flush()
 }
 
-func sum(filename string) (string, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return "", err
+// manifestFile returns the slash separated name of the manifest in the bundle
+// folder, with the extension ext unless -manifest-name gives the name.
+func (o options) manifestFile(ext string) string {
+	if o.file != "" {
+		return "manifests/" + o.file
 	}
-	defer f.Close()
+	return "manifests/manifest." + ext
+}
 
-	h := sha512.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", err
+// looksLikeBundle reports whether doc has any policy, proxy endpoint or shared
+// flow, which every real bundle does. It guards against writing into a
+// folder that merely happens to be named like a bundle.
+func looksLikeBundle(doc *manifest.Manifest) bool {
+	return len(doc.Policies.VersionInfo)+len(doc.ProxyEndpoints.VersionInfo)+len(doc.SharedFlows.VersionInfo) > 0
+}
+
+// manifestOutput returns the manifest file name to write data to, gzipped as
+// name.gz if compress is set.
+func manifestOutput(name string, data []byte, compress bool) (output, error) {
+	if !compress {
+		return output{name, data}, nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return output{}, err
+	}
+	if err := zw.Close(); err != nil {
+		return output{}, err
+	}
+	return output{name + ".gz", buf.Bytes()}, nil
+}
+
+// save writes files and logs how many entries each section of doc has.
+func save(logger log.Logger, src source, doc *manifest.Manifest, files []output) error {
+	if err := src.Save(files); err != nil {
+		return err
+	}
+	message := "manifest complete"
+	if _, ok := src.(patchSource); ok {
+		message = "patch complete, nothing written"
+	}
+	_ = level.Info(logger).Log(append([]interface{}{"message", message}, sectionCounts(doc)...)...)
+	return nil
+}
+
+// sectionCounts returns key/value pairs with the number of entries in each
+// section of doc and in total.
+func sectionCounts(doc *manifest.Manifest) []interface{} {
+	var keyvals []interface{}
+	total := 0
+	for _, section := range doc.Sections() {
+		key := strings.ToLower(section.Name[:1]) + section.Name[1:]
+		keyvals = append(keyvals, key, len(section.VersionInfo))
+		total += len(section.VersionInfo)
+	}
+	return append(keyvals, "files", total)
+}
+
+// cut slices s around the first sep, returning "" for after if there is none.
+func cut(s, sep string) (before, after string) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):]
 	}
+	return s, ""
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
 
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
 
-func marshal(v interface{}) ([]byte, error) {
-	xm, err := xml.MarshalIndent(v, "", "    ")
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [options] <folder>...\n\n", os.Args[0])
+	fmt.Fprintln(out, "Updates manifests/manifest.xml and the ManifestVersion of the main proxy")
+	fmt.Fprintln(out, "file in an apiproxy or sharedflowbundle folder. If <folder> does not end")
+	fmt.Fprintln(out, "in one of those, /apiproxy is appended. Several folders can be given at once.")
+	fmt.Fprintln(out, "Without any <folder>, the APIPROXY_DIR environment variable is used.")
+	fmt.Fprintln(out, "\nSubcommands, see <subcommand> -h:")
+	fmt.Fprintln(out, "  serve  serve manifests of uploaded zipped bundles over HTTP")
+	fmt.Fprintln(out, "  hash   print the version of one file")
+	fmt.Fprintln(out, "  diff   compare the resources of two bundles")
+	fmt.Fprintln(out, "  audit  check the shipped manifest of bundles against their files")
+	fmt.Fprintln(out, "\nOptions:")
+	visible := flag.NewFlagSet("", flag.ContinueOnError)
+	visible.SetOutput(out)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hidden[f.Name] {
+			visible.Var(f.Value, f.Name, f.Usage)
+			visible.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+	visible.PrintDefaults()
+}
+
+// hidden are tuning flags left out of the usage text.
+var hidden = map[string]bool{"read-buffer": true}
+
+// fixedTime returns the time given with -timestamp, as Unix seconds or in
+// RFC 3339, or else in SOURCE_DATE_EPOCH. It returns the zero time if neither
+// is set.
+func fixedTime(timestamp string) (time.Time, error) {
+	if timestamp == "" {
+		epoch := os.Getenv("SOURCE_DATE_EPOCH")
+		if epoch == "" {
+			return time.Time{}, nil
+		}
+		secs, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %s", epoch)
+		}
+		return time.Unix(secs, 0), nil
+	}
+	if secs, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, timestamp)
 	if err != nil {
-		return nil, err
+		return time.Time{}, fmt.Errorf("invalid timestamp %s", timestamp)
+	}
+	return t, nil
+}
+
+// time returns the fixed time if one was given, otherwise the current time.
+func (o options) time() time.Time {
+	if o.now.IsZero() {
+		return time.Now()
 	}
-	re := regexp.MustCompile("(></\\w+>)")
-	replace := []byte("/>")
-	xm = re.ReplaceAll(xm, replace) // https://github.com/golang/go/issues/21399
-	return xm, nil
+	return o.now
 }
 
-type Manifest struct {
-	Name     string `xml:"name,attr"`
-	Policies struct {
-		VersionInfo []VersionInfo
+// bundleFolder appends the bundle directory to the folder argument unless it
+// already names one. The appended segment is dir if given, otherwise the
+// first bundle directory in folder, in whatever casing, and apiproxy if
+// there is none. The argument is cleaned first, so trailing separators and .
+// segments don't matter.
+func bundleFolder(logger log.Logger, folder, dir string) string {
+	folder = filepath.Clean(folder)
+	if isBundleDir(filepath.Base(folder), dir) {
+		return folder
 	}
-	ProxyEndpoints struct {
-		VersionInfo []VersionInfo
+	suffix := dir
+	if suffix == "" {
+		suffix = "apiproxy"
+		entries, _ := os.ReadDir(folder)
+		for _, e := range entries {
+			if e.IsDir() && isBundleDir(e.Name(), "") {
+				suffix = e.Name()
+				break
+			}
+		}
+	}
+	_ = level.Info(logger).Log("message", "adding suffix /"+suffix)
+	return filepath.Join(folder, suffix)
+}
+
+// isBundleDir reports whether a directory called name holds a bundle: it is
+// dir if that is given, otherwise apiproxy or sharedflowbundle in any casing.
+func isBundleDir(name, dir string) bool {
+	if dir != "" {
+		return name == dir
+	}
+	return strings.EqualFold(name, "apiproxy") || strings.EqualFold(name, "sharedflowbundle")
+}
+
+// report is the summary written with -report.
+type report struct {
+	Name            string         `json:"name"`
+	Hash            string         `json:"hash"`
+	Files           map[string]int `json:"files"`
+	ManifestVersion string         `json:"manifestVersion"`
+	Generated       time.Time      `json:"generated"`
+}
+
+func writeReport(logger log.Logger, file string, bundle *manifest.Bundle, doc *manifest.Manifest, hash, manifestVersion string, generated time.Time) error {
+	r := report{
+		Name:            bundle.Name(),
+		Hash:            manifest.AlgorithmName(hash),
+		Files:           make(map[string]int),
+		ManifestVersion: manifestVersion,
+		Generated:       generated.UTC(),
 	}
-	Resources struct {
-		VersionInfo []VersionInfo
+	for _, section := range doc.Sections() {
+		r.Files[section.Name] = len(section.VersionInfo)
 	}
-	SharedFlows struct {
-		VersionInfo []VersionInfo
+	data, err := json.MarshalIndent(r, "", "    ")
+	if err != nil {
+		return err
 	}
-	TargetEndpoints struct {
-		VersionInfo []VersionInfo
+	if err := ioutil.WriteFile(file, append(data, '\n'), 0644); err != nil {
+		return err
 	}
+	_ = level.Info(logger).Log("message", "wrote "+file)
+	return nil
 }
 
-type VersionInfo struct {
-	ResourceName string `xml:"resourceName,attr"`
-	Version      string `xml:"version,attr"`
+// compareTo logs how doc differs from the manifest stored in file.
+func compareTo(logger log.Logger, file string, doc *manifest.Manifest) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var old manifest.Manifest
+	if err := xml.Unmarshal(data, &old); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	changes := manifest.Compare(&old, doc)
+	for _, c := range changes {
+		message := "changed"
+		switch {
+		case c.Old == "":
+			message = "added"
+		case c.New == "":
+			message = "removed"
+		}
+		_ = level.Info(logger).Log("message", message, "section", c.Section, "resourceName", c.ResourceName, "old", c.Old, "new", c.New)
+	}
+	_ = level.Info(logger).Log("message", "compared to "+file, "changes", len(changes))
+	return nil
 }
 
-type APIProxy struct {
-	Revision             string `xml:"revision,attr"`
-	Name                 string `xml:"name,attr"`
-	Basepaths            []string
-	ConfigurationVersion struct {
-		MajorVersion string `xml:"majorVersion,attr"`
-		MinorVersion string `xml:"minorVersion,attr"`
+// stripComment removes the comment following the XML declaration of a
+// manifest, if there is one. The comment names the tool version, so
+// manifests written by another build or with -no-comment compare equal.
+func stripComment(data string) string {
+	decl := ""
+	if strings.HasPrefix(data, "<?xml") {
+		if i := strings.Index(data, "\n"); i >= 0 {
+			decl, data = data[:i+1], data[i+1:]
+		}
 	}
-	CreatedAt       string
-	CreatedBy       string
-	Description     string
-	DisplayName     string
-	LastModifiedAt  string
-	LastModifiedBy  string
-	ManifestVersion string
-	Policies        struct {
-		Policy []string
+	if strings.HasPrefix(data, "<!--") {
+		if i := strings.Index(data, "-->\n"); i >= 0 {
+			data = data[i+len("-->\n"):]
+		}
+	}
+	return decl + data
+}
+
+// verify compares a freshly generated manifest against the one stored in the
+// bundle and the ManifestVersion recorded in proxyFile, logging every
+// difference. It reports false when anything is out of date. Data is the new
+// manifest without its comment. As the comment names the tool version, a
+// stored manifest that matches data is up to date if proxyFile records its
+// digest, and a missing or different one if it records manifestVersion.
+func verify(logger log.Logger, src source, doc *manifest.Manifest, data, manifestFile, proxyFile, current, manifestVersion string, opts manifest.Options) (bool, error) {
+	upToDate := true
+	want := manifestVersion
+	existing, err := src.ReadFile(manifestFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
 	}
-	ProxyEndpoints struct {
-		ProxyEndpoint []string
+	if os.IsNotExist(err) {
+		_ = level.Info(logger).Log("message", "manifest missing", "file", src.Path(manifestFile))
+		upToDate = false
+	} else {
+		var old manifest.Manifest
+		if err := xml.Unmarshal(existing, &old); err != nil {
+			return false, err
+		}
+		for _, c := range manifest.Compare(&old, doc) {
+			_ = level.Info(logger).Log("message", "version changed", "section", c.Section, "resourceName", c.ResourceName, "old", c.Old, "new", c.New)
+			upToDate = false
+		}
+		if stripComment(string(existing)) != data {
+			_ = level.Info(logger).Log("message", "manifest content differs", "file", src.Path(manifestFile))
+			upToDate = false
+		} else if want, err = manifest.Version(bytes.NewReader(existing), opts); err != nil {
+			return false, err
+		}
 	}
-	Resources struct {
-		Resource []string
+	if current != want {
+		_ = level.Info(logger).Log("message", "ManifestVersion differs", "file", src.Path(proxyFile), "old", current, "new", want)
+		upToDate = false
 	}
-	Spec            string
-	TargetServers   string
-	TargetEndpoints string
+	return upToDate, nil
 }
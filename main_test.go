@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/philschleier/apiproxy-manifest/manifest"
+)
+
+func TestBundleFolder(t *testing.T) {
+	root := t.TempDir()
+	abs := filepath.Join(root, "proxy", "apiproxy")
+	flow := filepath.Join(root, "flow")
+	if err := os.MkdirAll(filepath.Join(flow, "SharedFlowBundle"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		folder string
+		dir    string
+		want   string
+	}{
+		{"apiproxy", "", "apiproxy"},
+		{"apiproxy/", "", "apiproxy"},
+		{"./apiproxy", "", "apiproxy"},
+		{abs, "", abs},
+		{abs + "/", "", abs},
+		{"proxy", "", filepath.Join("proxy", "apiproxy")},
+		{"proxy/.", "", filepath.Join("proxy", "apiproxy")},
+		{flow, "", filepath.Join(flow, "SharedFlowBundle")},
+		{"proxy", "bundle", filepath.Join("proxy", "bundle")},
+		{"proxy/bundle", "bundle", filepath.Join("proxy", "bundle")},
+	}
+	for _, tt := range tests {
+		if got := bundleFolder(log.NewNopLogger(), tt.folder, tt.dir); got != tt.want {
+			t.Errorf("bundleFolder(%q, %q) = %q, want %q", tt.folder, tt.dir, got, tt.want)
+		}
+	}
+}
+
+// writeBundle writes the files of a small API proxy into a temporary folder
+// and returns its apiproxy folder.
+func writeBundle(t *testing.T, files map[string]string) string {
+	t.Helper()
+	folder := filepath.Join(t.TempDir(), "apiproxy")
+	for name, data := range files {
+		path := filepath.Join(folder, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return folder
+}
+
+var testProxy = map[string]string{
+	"p1.xml":              "<APIProxy name=\"p1\">\n    <ConfigurationVersion majorVersion=\"4\" minorVersion=\"0\"/>\n    <ManifestVersion>SHA-512:old</ManifestVersion>\n    <Policies>\n        <Policy>AM-1</Policy>\n    </Policies>\n    <ProxyEndpoints>\n        <ProxyEndpoint>default</ProxyEndpoint>\n    </ProxyEndpoints>\n</APIProxy>\n",
+	"policies/AM-1.xml":   "<AssignMessage name=\"AM-1\"/>\n",
+	"proxies/default.xml": "<ProxyEndpoint name=\"default\"/>\n",
+	"resources/jsc/a.js":  "var a = 1;\n",
+	"targets/default.xml": "<TargetEndpoint name=\"default\"/>\n",
+}
+
+// TestManifestVersionMatchesFile checks that the ManifestVersion recorded in
+// the proxy file is the digest of manifest.xml as written, with and without
+// the tool version comment, and that the result verifies.
+func TestManifestVersionMatchesFile(t *testing.T) {
+	for _, comment := range []bool{true, false} {
+		folder := writeBundle(t, testProxy)
+		opts := options{Options: manifest.Options{Hash: "sha512", Logger: log.NewNopLogger()}, noCache: true, comment: comment, out: ioutil.Discard}
+		src := folderSource{folder: folder, logger: log.NewNopLogger()}
+		if err := run(context.Background(), src, opts); err != nil {
+			t.Fatalf("comment=%v: run: %v", comment, err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(folder, "manifests", "manifest.xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(string(data), "<!--"); got != comment {
+			t.Errorf("comment=%v: manifest has a comment: %v", comment, got)
+		}
+		sum := sha512.Sum512(data)
+		want := "SHA-512:" + hex.EncodeToString(sum[:])
+		bundle, err := manifest.FindBundle(folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bundle.ManifestVersion(); got != want {
+			t.Errorf("comment=%v: ManifestVersion = %s, want sha512 of manifest.xml %s", comment, got, want)
+		}
+
+		opts.verify = true
+		opts.comment = !comment
+		if err := run(context.Background(), src, opts); err != nil {
+			t.Errorf("comment=%v: verify with comment=%v: %v", comment, !comment, err)
+		}
+	}
+}
+
+// TestProcessBundles processes several bundles at once, each hashed by
+// several workers that log concurrently, run it with -race. The log lines of
+// every bundle are written together, in the order of the targets.
+func TestProcessBundles(t *testing.T) {
+	var targets []string
+	for i := 0; i < 4; i++ {
+		files := make(map[string]string)
+		for name, data := range testProxy {
+			files[name] = data
+		}
+		// Jobs isn't set on the command line, so it comes from the config.
+		files[configFile] = `{"jobs": 4}`
+		for j := 0; j < 20; j++ {
+			files[fmt.Sprintf("resources/jsc/f%02d.js", j)] = fmt.Sprintf("var f%02d = %d;\n", j, i)
+		}
+		targets = append(targets, writeBundle(t, files))
+	}
+	outs := make([]string, len(targets))
+	opts := options{Options: manifest.Options{Hash: "sha512"}, noCache: true}
+	newLogger := func(w io.Writer) log.Logger {
+		return level.NewFilter(log.NewLogfmtLogger(w), level.AllowDebug())
+	}
+	var stderr, stdout bytes.Buffer
+	failed, stale := processBundles(context.Background(), targets, outs, "", 3, opts, newLogger, &stderr, &stdout)
+	if len(failed) > 0 || len(stale) > 0 {
+		t.Fatalf("processBundles failed %v, out of date %v\n%s", failed, stale, stderr.String())
+	}
+
+	next := 0
+	for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+		for next < len(targets) && !strings.Contains(line, "bundle="+targets[next]) {
+			next++
+		}
+		if next == len(targets) {
+			t.Fatalf("log line %q is out of order or not of any bundle:\n%s", line, stderr.String())
+		}
+	}
+	for _, target := range targets {
+		if _, err := os.Stat(filepath.Join(target, "manifests", "manifest.xml")); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package manifest
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bundle is the main descriptor file of a bundle folder. Exactly one of
+// APIProxy and SharedFlow is set.
+type Bundle struct {
+	Path       string
+	APIProxy   *APIProxy
+	SharedFlow *SharedFlowBundle
+
+	raw []byte // the descriptor file as read
+}
+
+// FindBundle locates and parses the main descriptor in folder, preferring an
+// APIProxy and falling back to a SharedFlowBundle.
+func FindBundle(folder string) (*Bundle, error) {
+	b, err := FindBundleFS(os.DirFS(folder))
+	if err != nil {
+		return nil, inFolder(folder, err)
+	}
+	b.Path = filepath.Join(folder, filepath.FromSlash(b.Path))
+	return b, nil
+}
+
+// FindBundleFS is like FindBundle for a bundle folder exposed as fsys. The
+// returned Path is relative to the root of fsys.
+func FindBundleFS(fsys fs.FS) (*Bundle, error) {
+	path, proxy, err := findProxyFile(fsys)
+	if err == nil {
+		raw, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return nil, err
+		}
+		return &Bundle{Path: path, APIProxy: proxy, raw: raw}, nil
+	}
+	if _, ambiguous := err.(*AmbiguousError); ambiguous {
+		return nil, err
+	}
+	path, sharedflow, serr := findSharedFlowFile(fsys)
+	if serr != nil {
+		return nil, err
+	}
+	raw, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	return &Bundle{Path: path, SharedFlow: sharedflow, raw: raw}, nil
+}
+
+// ManifestVersion returns the ManifestVersion recorded in the descriptor.
+func (b *Bundle) ManifestVersion() string {
+	if b.SharedFlow != nil {
+		return b.SharedFlow.ManifestVersion
+	}
+	return b.APIProxy.ManifestVersion
+}
+
+// Name returns the name attribute of the descriptor.
+func (b *Bundle) Name() string {
+	if b.SharedFlow != nil {
+		return b.SharedFlow.Name
+	}
+	return b.APIProxy.Name
+}
+
+// ConfigurationVersion returns the major and minor configuration version of
+// the descriptor. Apigee expects major version 4.
+func (b *Bundle) ConfigurationVersion() (major, minor string) {
+	if b.SharedFlow != nil {
+		return b.SharedFlow.ConfigurationVersion.MajorVersion, b.SharedFlow.ConfigurationVersion.MinorVersion
+	}
+	return b.APIProxy.ConfigurationVersion.MajorVersion, b.APIProxy.ConfigurationVersion.MinorVersion
+}
+
+// SetManifestVersion updates the ManifestVersion of the descriptor.
+func (b *Bundle) SetManifestVersion(version string) {
+	if b.SharedFlow != nil {
+		b.SharedFlow.ManifestVersion = version
+		return
+	}
+	b.APIProxy.ManifestVersion = version
+}
+
+// BumpRevision increments the revision attribute of the descriptor and
+// returns the new value. The revision is left alone if it is not a plain
+// decimal integer.
+func (b *Bundle) BumpRevision() (string, error) {
+	revision := &b.APIProxy.Revision
+	if b.SharedFlow != nil {
+		revision = &b.SharedFlow.Revision
+	}
+	n, err := strconv.Atoi(*revision)
+	if err != nil || n < 0 || strconv.Itoa(n) != *revision {
+		return "", fmt.Errorf("revision %q is not an integer", *revision)
+	}
+	*revision = strconv.Itoa(n + 1)
+	return *revision, nil
+}
+
+// SetModified records when and by whom the bundle was last modified, with the
+// time in milliseconds since the epoch as Apigee writes it.
+func (b *Bundle) SetModified(at time.Time, by string) {
+	millis := strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10)
+	if b.SharedFlow != nil {
+		b.SharedFlow.LastModifiedAt, b.SharedFlow.LastModifiedBy = millis, by
+		return
+	}
+	b.APIProxy.LastModifiedAt, b.APIProxy.LastModifiedBy = millis, by
+}
+
+// Write serializes the descriptor to w. A descriptor read by FindBundle is
+// written as the original file with only the changed elements and attributes
+// replaced, so formatting and elements this package doesn't know are kept.
+// Otherwise, or if fields other than the revision, Basepaths, last modified
+// time and user and ManifestVersion changed, it is formatted like
+// WriteManifest.
+func (b *Bundle) Write(w io.Writer) error {
+	return b.WriteFormat(w, Format{})
+}
+
+// WriteFormat is like Write with the layout f, which only applies when the
+// descriptor is serialized from scratch.
+func (b *Bundle) WriteFormat(w io.Writer, f Format) error {
+	if b.raw != nil && !f.FullRewrite {
+		data, ok, err := b.patch()
+		if err != nil {
+			return err
+		}
+		if ok {
+			_, err = w.Write(data)
+			return err
+		}
+	}
+	return writeXML(w, b.descriptor(), f)
+}
+
+// descriptor returns the APIProxy or SharedFlowBundle.
+func (b *Bundle) descriptor() interface{} {
+	if b.SharedFlow != nil {
+		return b.SharedFlow
+	}
+	return b.APIProxy
+}
+
+// AmbiguousError is returned when a bundle folder holds more than one main
+// descriptor, so there is no telling which one to update.
+type AmbiguousError struct {
+	Candidates []string
+}
+
+func (e *AmbiguousError) Error() string {
+	return "found more than one main proxy file: " + strings.Join(e.Candidates, ", ")
+}
+
+// findProxyFile returns the only APIProxy descriptor in the folder.
+func findProxyFile(fsys fs.FS) (string, *APIProxy, error) {
+	files, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return "", nil, err
+	}
+	var candidates []string
+	var found *APIProxy
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(file.Name(), ".xml") {
+			path := file.Name()
+			ok, proxy := checkProxyFile(fsys, path)
+			if ok {
+				candidates = append(candidates, path)
+				found = proxy
+			}
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return "", nil, errors.New("didnt find main proxy file")
+	case 1:
+		return candidates[0], found, nil
+	default:
+		return "", nil, &AmbiguousError{Candidates: candidates}
+	}
+}
+
+// checkProxyFile parses path as an APIProxy descriptor. Other well-formed XML
+// files, like edgestate.xml or a SharedFlowBundle, are rejected by the XMLName
+// of APIProxy.
+func checkProxyFile(fsys fs.FS, path string) (bool, *APIProxy) {
+	c, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		return false, nil
+	}
+	var p APIProxy
+	err = xml.Unmarshal(c, &p)
+	if err != nil {
+		return false, nil
+	}
+	return true, &p
+}
+
+func findSharedFlowFile(fsys fs.FS) (string, *SharedFlowBundle, error) {
+	files, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return "", nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(file.Name(), ".xml") {
+			path := file.Name()
+			ok, bundle := checkSharedFlowFile(fsys, path)
+			if ok {
+				return path, bundle, nil
+			}
+		}
+	}
+	return "", nil, errors.New("didnt find main shared flow file")
+}
+
+func checkSharedFlowFile(fsys fs.FS, path string) (bool, *SharedFlowBundle) {
+	c, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		return false, nil
+	}
+	var b SharedFlowBundle
+	err = xml.Unmarshal(c, &b) // fails unless the root element is SharedFlowBundle
+	if err != nil {
+		return false, nil
+	}
+	return true, &b
+}
+
+type APIProxy struct {
+	XMLName              xml.Name `xml:"APIProxy"`
+	Revision             string   `xml:"revision,attr"`
+	Name                 string   `xml:"name,attr"`
+	Basepaths            []string
+	ConfigurationVersion struct {
+		MajorVersion string `xml:"majorVersion,attr"`
+		MinorVersion string `xml:"minorVersion,attr"`
+	}
+	CreatedAt       string
+	CreatedBy       string
+	Description     string
+	DisplayName     string
+	LastModifiedAt  string
+	LastModifiedBy  string
+	ManifestVersion string
+	Policies        struct {
+		Policy []string
+	}
+	ProxyEndpoints struct {
+		ProxyEndpoint []string
+	}
+	Resources struct {
+		Resource []string
+	}
+	Spec            string
+	TargetServers   string
+	TargetEndpoints struct {
+		TargetEndpoint []string
+	}
+	Other []Element `xml:",any"`
+}
+
+type SharedFlowBundle struct {
+	XMLName              xml.Name `xml:"SharedFlowBundle"`
+	Revision             string   `xml:"revision,attr"`
+	Name                 string   `xml:"name,attr"`
+	ConfigurationVersion struct {
+		MajorVersion string `xml:"majorVersion,attr"`
+		MinorVersion string `xml:"minorVersion,attr"`
+	}
+	CreatedAt       string
+	CreatedBy       string
+	Description     string
+	DisplayName     string
+	LastModifiedAt  string
+	LastModifiedBy  string
+	ManifestVersion string
+	Policies        struct {
+		Policy []string
+	}
+	Resources struct {
+		Resource []string
+	}
+	Spec        string
+	SharedFlows struct {
+		SharedFlow []string
+	}
+	SubType string
+	Other   []Element `xml:",any"`
+}
+
+// Element is a child element of a descriptor that is not modelled by its
+// fields. It is kept as is so a rewritten descriptor doesn't lose it.
+type Element struct {
+	XMLName xml.Name
+	Attr    []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
@@ -0,0 +1,51 @@
+package manifest
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// TestFullRewriteTargetEndpoints checks that a proxy file serialized from
+// scratch keeps every TargetEndpoint as an element of its own.
+func TestFullRewriteTargetEndpoints(t *testing.T) {
+	fsys := fstest.MapFS{
+		"p1.xml": {Data: []byte(`<APIProxy revision="1" name="p1">
+    <ProxyEndpoints>
+        <ProxyEndpoint>default</ProxyEndpoint>
+    </ProxyEndpoints>
+    <TargetEndpoints>
+        <TargetEndpoint>backend</TargetEndpoint>
+        <TargetEndpoint>fallback</TargetEndpoint>
+    </TargetEndpoints>
+</APIProxy>
+`)},
+	}
+	bundle, err := FindBundleFS(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"backend", "fallback"}
+	if got := bundle.APIProxy.TargetEndpoints.TargetEndpoint; !reflect.DeepEqual(got, want) {
+		t.Fatalf("TargetEndpoints = %q, want %q", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := bundle.WriteFormat(&buf, Format{FullRewrite: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range want {
+		if elem := "<TargetEndpoint>" + name + "</TargetEndpoint>"; !strings.Contains(buf.String(), elem) {
+			t.Errorf("rewritten proxy file lacks %s:\n%s", elem, buf.String())
+		}
+	}
+	rewritten, err := FindBundleFS(fstest.MapFS{"p1.xml": {Data: buf.Bytes()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rewritten.APIProxy.TargetEndpoints.TargetEndpoint; !reflect.DeepEqual(got, want) {
+		t.Errorf("TargetEndpoints after the rewrite = %q, want %q", got, want)
+	}
+}
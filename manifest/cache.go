@@ -0,0 +1,137 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Cache remembers the digests of files between runs so unchanged files, going
+// by modification time and size, are not hashed again. It is safe for
+// concurrent use.
+type Cache struct {
+	mu      sync.Mutex
+	setting string
+	entries map[string]cacheEntry
+	used    map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	ModTime time.Time `json:"modTime"`
+	Size    int64     `json:"size"`
+	Digest  string    `json:"digest"`
+}
+
+// cacheFile is the serialized form of a Cache. Setting records the options
+// the digests were computed with; entries made with other settings are
+// discarded.
+type cacheFile struct {
+	Setting string                `json:"setting"`
+	Entries map[string]cacheEntry `json:"entries"`
+}
+
+// NewCache returns an empty cache.
+func NewCache() *Cache {
+	return &Cache{entries: make(map[string]cacheEntry), used: make(map[string]cacheEntry)}
+}
+
+// LoadCache reads a cache written by Save. A missing file yields an empty
+// cache.
+func LoadCache(filename string) (*Cache, error) {
+	c := NewCache()
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f cacheFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	c.setting = f.Setting
+	if f.Entries != nil {
+		c.entries = f.Entries
+	}
+	return c, nil
+}
+
+// Save writes the entries used since the cache was loaded, so files that
+// disappeared from the bundle are dropped. Missing parent directories are
+// created.
+func (c *Cache) Save(filename string) error {
+	c.mu.Lock()
+	data, err := json.MarshalIndent(cacheFile{Setting: c.setting, Entries: c.used}, "", "    ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// reset drops all entries unless they were computed with setting.
+func (c *Cache) reset(setting string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.setting != setting {
+		c.setting = setting
+		c.entries = make(map[string]cacheEntry)
+	}
+}
+
+func (c *Cache) get(name string, fi fs.FileInfo) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[name]
+	if !ok || !e.ModTime.Equal(fi.ModTime()) || e.Size != fi.Size() {
+		return "", false
+	}
+	c.used[name] = e
+	return e.Digest, true
+}
+
+func (c *Cache) put(name string, fi fs.FileInfo, digest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := cacheEntry{ModTime: fi.ModTime(), Size: fi.Size(), Digest: digest}
+	c.entries[name] = e
+	c.used[name] = e
+}
+
+// cachedSum is sum of the file of the entry resourceName, consulting
+// opts.Cache first if there is one. It reports whether the digest came from
+// the cache. With HashPath the digest depends on the resource name as well,
+// which -resource-map can change for the same file, so it is part of the key.
+func cachedSum(ctx context.Context, fsys fs.FS, filename, resourceName string, opts Options) (string, bool, error) {
+	key := filename
+	if opts.HashPath {
+		key += "\x00" + resourceName
+	}
+	opts = opts.forResource(resourceName)
+	if opts.Cache == nil {
+		sha, err := sum(ctx, fsys, filename, opts)
+		return sha, false, err
+	}
+	fi, err := fs.Stat(fsys, filename)
+	if err != nil {
+		return "", false, err
+	}
+	if digest, ok := opts.Cache.get(key, fi); ok {
+		return digest, true, nil
+	}
+	digest, err := sum(ctx, fsys, filename, opts)
+	if err != nil {
+		return "", false, err
+	}
+	opts.Cache.put(key, fi, digest)
+	return digest, false, nil
+}
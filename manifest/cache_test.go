@@ -0,0 +1,32 @@
+package manifest
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+// TestCacheHashPathResourceMap checks that with HashPath a digest cached
+// under one resource name isn't reused once ResourceMap renames the file.
+func TestCacheHashPathResourceMap(t *testing.T) {
+	fsys := fstest.MapFS{
+		"p1.xml":                 {Data: []byte(`<APIProxy name="p1"/>`)},
+		"resources/scripts/a.js": {Data: []byte("var a = 1;\n")},
+	}
+	cache := NewCache()
+	for _, scheme := range []string{"jsc", "js"} {
+		opts := Options{HashPath: true, ResourceMap: map[string]string{"scripts": scheme}}
+		want, err := GenerateFS(fsys, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Cache = cache
+		got, err := GenerateFS(fsys, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Resources, want.Resources) {
+			t.Errorf("scripts mapped to %s: cached resources %v, want %v", scheme, got.Resources, want.Resources)
+		}
+	}
+}
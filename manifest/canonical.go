@@ -0,0 +1,106 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// canonicalXML rewrites an XML document so that formatting differences that
+// don't change its meaning don't change its digest either: attributes are
+// sorted, whitespace around character data is trimmed and the XML declaration
+// is dropped. Namespace prefixes are kept as written.
+func canonicalXML(r io.Reader) ([]byte, error) {
+	d := xml.NewDecoder(r)
+	var out bytes.Buffer
+	var open []string // RawToken doesn't check that elements are balanced
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			if len(open) > 0 {
+				return nil, fmt.Errorf("element <%s> not closed", open[len(open)-1])
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			open = append(open, qualified(t.Name))
+			out.WriteString("<" + qualified(t.Name))
+			attrs := append([]xml.Attr(nil), t.Attr...)
+			sort.Slice(attrs, func(i, j int) bool { return qualified(attrs[i].Name) < qualified(attrs[j].Name) })
+			for _, a := range attrs {
+				out.WriteString(" " + qualified(a.Name) + `="`)
+				if err := xml.EscapeText(&out, []byte(a.Value)); err != nil {
+					return nil, err
+				}
+				out.WriteString(`"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if len(open) == 0 || open[len(open)-1] != qualified(t.Name) {
+				return nil, fmt.Errorf("unexpected end element </%s>", qualified(t.Name))
+			}
+			open = open[:len(open)-1]
+			out.WriteString("</" + qualified(t.Name) + ">")
+		case xml.CharData:
+			if err := xml.EscapeText(&out, bytes.TrimSpace(t)); err != nil {
+				return nil, err
+			}
+		case xml.Comment:
+			out.WriteString("<!--" + strings.TrimSpace(string(t)) + "-->")
+		case xml.ProcInst:
+			if t.Target != "xml" {
+				out.WriteString("<?" + t.Target + " " + string(bytes.TrimSpace(t.Inst)) + "?>")
+			}
+		case xml.Directive:
+			out.WriteString("<!" + string(t) + ">")
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// checkXML fails unless filename, if it is an .xml file, is well-formed XML
+// with a root element.
+func checkXML(fsys fs.FS, filename string) error {
+	if !strings.HasSuffix(filename, ".xml") {
+		return nil
+	}
+	f, err := fsys.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d := xml.NewDecoder(f)
+	root := false
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &fs.PathError{Op: "parse", Path: filename, Err: err}
+		}
+		if _, ok := tok.(xml.StartElement); ok {
+			root = true
+		}
+	}
+	if !root {
+		return &fs.PathError{Op: "parse", Path: filename, Err: errors.New("no root element")}
+	}
+	return nil
+}
+
+func qualified(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
@@ -0,0 +1,104 @@
+package manifest
+
+import "strings"
+
+// Issue kinds reported by Check.
+const (
+	// Missing means the descriptor lists a name without a matching file.
+	Missing = "missing"
+	// Orphaned means a file exists that the descriptor does not list.
+	Orphaned = "orphaned"
+	// UnknownType means a resource name has a scheme Apigee doesn't accept.
+	UnknownType = "unknown-type"
+	// Incomplete means the descriptor lacks a required attribute or element,
+	// given as Name.
+	Incomplete = "incomplete"
+)
+
+// ResourceTypes are the resource types, and so the resource name schemes,
+// that Apigee accepts.
+var ResourceTypes = []string{"jsc", "java", "py", "node", "xsl", "wsdl", "xsd", "hosted", "properties"}
+
+// CheckResourceTypes reports every resource of m whose scheme is neither one
+// of ResourceTypes nor in extra, such as a typo in a resources subdirectory.
+func CheckResourceTypes(m *Manifest, extra []string) []Issue {
+	known := make(map[string]bool)
+	for _, t := range append(append([]string(nil), ResourceTypes...), extra...) {
+		known[t] = true
+	}
+	var issues []Issue
+	for _, v := range m.Resources.VersionInfo {
+		scheme := strings.SplitN(v.ResourceName, "://", 2)[0]
+		if !known[scheme] {
+			issues = append(issues, Issue{UnknownType, "Resources", v.ResourceName})
+		}
+	}
+	return issues
+}
+
+// CheckDescriptor reports the parts of the descriptor of b that Apigee
+// requires but that are missing or empty: the name and revision attributes
+// and, for an API proxy, at least one ProxyEndpoint.
+func CheckDescriptor(b *Bundle) []Issue {
+	var issues []Issue
+	require := func(section, name, value string) {
+		if strings.TrimSpace(value) == "" {
+			issues = append(issues, Issue{Incomplete, section, name})
+		}
+	}
+	if p := b.APIProxy; p != nil {
+		require("APIProxy", "name", p.Name)
+		require("APIProxy", "revision", p.Revision)
+		if len(p.ProxyEndpoints.ProxyEndpoint) == 0 {
+			issues = append(issues, Issue{Incomplete, "ProxyEndpoints", "ProxyEndpoint"})
+		}
+	}
+	if sf := b.SharedFlow; sf != nil {
+		require("SharedFlowBundle", "name", sf.Name)
+		require("SharedFlowBundle", "revision", sf.Revision)
+	}
+	return issues
+}
+
+// Issue is an inconsistency between the main descriptor and the files that
+// were hashed into the manifest.
+type Issue struct {
+	Kind    string
+	Section string
+	Name    string
+}
+
+// Check cross-checks the policy, endpoint and resource names declared in the
+// descriptor of b against the entries of m.
+func Check(b *Bundle, m *Manifest) []Issue {
+	var issues []Issue
+	check := func(section string, declared []string, found []VersionInfo) {
+		have := make(map[string]bool)
+		for _, v := range found {
+			have[v.ResourceName] = true
+		}
+		listed := make(map[string]bool)
+		for _, name := range declared {
+			listed[name] = true
+			if !have[name] {
+				issues = append(issues, Issue{Missing, section, name})
+			}
+		}
+		for _, v := range found {
+			if !listed[v.ResourceName] {
+				issues = append(issues, Issue{Orphaned, section, v.ResourceName})
+			}
+		}
+	}
+	if p := b.APIProxy; p != nil {
+		check("Policies", p.Policies.Policy, m.Policies.VersionInfo)
+		check("ProxyEndpoints", p.ProxyEndpoints.ProxyEndpoint, m.ProxyEndpoints.VersionInfo)
+		check("Resources", p.Resources.Resource, m.Resources.VersionInfo)
+	}
+	if sf := b.SharedFlow; sf != nil {
+		check("Policies", sf.Policies.Policy, m.Policies.VersionInfo)
+		check("SharedFlows", sf.SharedFlows.SharedFlow, m.SharedFlows.VersionInfo)
+		check("Resources", sf.Resources.Resource, m.Resources.VersionInfo)
+	}
+	return issues
+}
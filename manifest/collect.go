@@ -0,0 +1,336 @@
+package manifest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+func stripSuffix(suffix string) func(file fs.FileInfo) string {
+	suffix = "." + suffix
+	return func(file fs.FileInfo) string {
+		return strings.TrimSuffix(file.Name(), suffix)
+	}
+}
+
+// calculateAll hashes every file directly in dir, naming each with resourceName.
+func calculateAll(ctx context.Context, fsys fs.FS, dir string, resourceName func(fs.FileInfo) string, opts Options) ([]VersionInfo, error) {
+	all, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCase(dir, all, opts); err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	for _, entry := range all {
+		if opts.skipped(path.Join(dir, entry.Name()), entry.IsDir()) {
+			continue
+		}
+		if generated(entry.Name(), entry.IsDir()) {
+			_ = level.Warn(opts.Logger).Log("message", "skipping generated manifest in unexpected location", "file", path.Join(dir, entry.Name()))
+			continue
+		}
+		file, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		name := resourceName(file)
+		if other, ok := files[name]; ok {
+			return nil, fmt.Errorf("%s and %s both have the resource name %s", other, path.Join(dir, file.Name()), name)
+		}
+		files[name] = path.Join(dir, file.Name())
+	}
+	if opts.StrictXML {
+		for _, file := range files {
+			if err := checkXML(fsys, file); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return hashFiles(ctx, fsys, dir, files, opts)
+}
+
+// calculateTree hashes every file below dir, naming each scheme://path with
+// the slash separated path relative to dir.
+func calculateTree(ctx context.Context, fsys fs.FS, dir, scheme string, opts Options) ([]VersionInfo, error) {
+	files := make(map[string]string)
+	if err := collectTree(ctx, fsys, dir, dir, scheme, files, nil, opts); err != nil {
+		return nil, err
+	}
+	if opts.VerifySidecars {
+		paths := make(map[string]bool, len(files))
+		for _, file := range files {
+			paths[file] = true
+		}
+		for name, file := range files {
+			// A sidecar describes the file next to it and is not a
+			// resource of its own.
+			if strings.HasSuffix(file, ".sha512") && paths[strings.TrimSuffix(file, ".sha512")] {
+				delete(files, name)
+			}
+		}
+		for _, file := range files {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if err := verifySidecar(fsys, file); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return hashFiles(ctx, fsys, dir, files, opts)
+}
+
+// collectTree adds the files below name to files. Symlinks are skipped with a
+// warning unless opts.FollowSymlinks is set. ancestors are the directories
+// above name, to detect symlinks that lead back up the tree.
+func collectTree(ctx context.Context, fsys fs.FS, dir, name, scheme string, files map[string]string, ancestors []fs.FileInfo, opts Options) error {
+	fi, err := fs.Stat(fsys, name)
+	if err != nil {
+		return err
+	}
+	for _, a := range ancestors {
+		if os.SameFile(a, fi) {
+			return &fs.PathError{Op: "walk", Path: name, Err: errors.New("symlink loop")}
+		}
+	}
+	ancestors = append(ancestors, fi)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	entries, err := fs.ReadDir(fsys, name)
+	if err != nil {
+		return err
+	}
+	if err := checkCase(name, entries, opts); err != nil {
+		return err
+	}
+	for _, d := range entries {
+		if opts.skipped(path.Join(name, d.Name()), d.IsDir()) {
+			continue
+		}
+		file := path.Join(name, d.Name())
+		isDir := d.IsDir()
+		if d.Type()&fs.ModeSymlink != 0 {
+			if !opts.FollowSymlinks {
+				_ = level.Warn(opts.Logger).Log("message", "skipping symlink", "file", file)
+				continue
+			}
+			target, err := fs.Stat(fsys, file)
+			if err != nil {
+				return err
+			}
+			isDir = target.IsDir()
+		}
+		if generated(d.Name(), isDir) {
+			_ = level.Warn(opts.Logger).Log("message", "skipping generated manifest in unexpected location", "file", file)
+			continue
+		}
+		if isDir {
+			if err := collectTree(ctx, fsys, dir, file, scheme, files, ancestors, opts); err != nil {
+				return err
+			}
+			continue
+		}
+		if !opts.resourceAllowed(d.Name()) {
+			continue
+		}
+		files[scheme+"://"+strings.TrimPrefix(file, dir+"/")] = file
+	}
+	return nil
+}
+
+// generated reports whether a file or directory called name holds output of
+// this tool: a manifests directory or a manifest.xml file. They are never
+// hashed, so a manifest can't end up in a manifest.
+func generated(name string, isDir bool) bool {
+	if isDir {
+		return strings.EqualFold(name, "manifests")
+	}
+	return strings.EqualFold(name, "manifest.xml")
+}
+
+// hashFiles hashes the files of dir, keyed by resource name, using up to
+// opts.Jobs concurrent workers. The result is sorted by resource name
+// regardless of completion order.
+func hashFiles(ctx context.Context, fsys fs.FS, dir string, files map[string]string, opts Options) ([]VersionInfo, error) {
+	infos := make([]VersionInfo, len(files))
+	sorted := make([]string, 0, len(files))
+	for name := range files {
+		sorted = append(sorted, name)
+	}
+	if opts.NaturalSort {
+		sort.Slice(sorted, func(i, j int) bool { return naturalLess(sorted[i], sorted[j]) })
+	} else {
+		sort.Strings(sorted)
+	}
+
+	sizes := make([]int64, len(sorted))
+	for i, name := range sorted {
+		fi, err := fs.Stat(fsys, files[name])
+		if err != nil {
+			return nil, err
+		}
+		if err := checkEmpty(files[name], fi.Size(), opts); err != nil {
+			return nil, err
+		}
+		if opts.MaxFileSize > 0 && fi.Size() > opts.MaxFileSize {
+			return nil, &fs.PathError{Op: "hash", Path: files[name], Err: fmt.Errorf("file size %d bytes exceeds the limit of %d bytes", fi.Size(), opts.MaxFileSize)}
+		}
+		sizes[i] = fi.Size()
+	}
+
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	errs := make([]error, len(sorted))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex // serializes opts.Progress
+	done := 0
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := range work {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				file := sorted[i]
+				sha, cached, err := cachedSum(ctx, fsys, files[file], file, opts)
+				if opts.Progress != nil {
+					mu.Lock()
+					done++
+					opts.Progress(dir, done, len(sorted))
+					mu.Unlock()
+				}
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				infos[i] = VersionInfo{
+					ResourceName: file,
+					Version:      opts.version(sha),
+				}
+				if opts.IncludeSize {
+					size := sizes[i]
+					infos[i].Size = &size
+				}
+				_ = level.Debug(opts.Logger).Log("message", "hashed", "file", files[file], "resourceName", file, "version", infos[i].Version, "cached", cached, "worker", worker)
+			}
+		}(w)
+	}
+feed:
+	for i := range sorted {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var failed Errors
+	for _, err := range errs {
+		if err != nil && opts.FailFast {
+			return nil, err
+		}
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	switch len(failed) {
+	case 0:
+		return infos, nil
+	case 1:
+		return nil, failed[0]
+	}
+	return nil, failed
+}
+
+// checkCase fails if two entries of dir have names that differ only in case.
+// Only one of them survives a checkout on a case-insensitive file system, so
+// the manifest would depend on where it is generated.
+func checkCase(dir string, entries []fs.DirEntry, opts Options) error {
+	seen := make(map[string]string)
+	for _, e := range entries {
+		if opts.skipped(path.Join(dir, e.Name()), e.IsDir()) {
+			continue
+		}
+		folded := strings.ToLower(e.Name())
+		if other, ok := seen[folded]; ok {
+			return fmt.Errorf("%s and %s differ only in case", path.Join(dir, other), path.Join(dir, e.Name()))
+		}
+		seen[folded] = e.Name()
+	}
+	return nil
+}
+
+// checkEmpty warns about a zero-byte file, which usually means a generation
+// step failed, or rejects it if opts.FailOnZeroByte is set.
+func checkEmpty(file string, size int64, opts Options) error {
+	if size > 0 {
+		return nil
+	}
+	if opts.FailOnZeroByte {
+		return &fs.PathError{Op: "hash", Path: file, Err: errors.New("file is empty")}
+	}
+	_ = level.Warn(opts.Logger).Log("message", "empty file", "file", file)
+	return nil
+}
+
+// naturalLess compares a and b treating runs of digits as numbers. Names that
+// compare equal that way (like "a01" and "a1") fall back to byte order, so the
+// result is a total order.
+func naturalLess(a, b string) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if isDigit(a[i]) && isDigit(b[j]) {
+			si, sj := i, j
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			x := strings.TrimLeft(a[si:i], "0")
+			y := strings.TrimLeft(b[sj:j], "0")
+			if len(x) != len(y) {
+				return len(x) < len(y)
+			}
+			if x != y {
+				return x < y
+			}
+			continue
+		}
+		if a[i] != b[j] {
+			return a[i] < b[j]
+		}
+		i++
+		j++
+	}
+	if len(a)-i != len(b)-j {
+		return len(a)-i < len(b)-j
+	}
+	return a < b
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
@@ -0,0 +1,107 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+// testFiles returns n resource files of about 4 KB each in jsc, and the
+// resourceName to path mapping hashFiles takes.
+func testFiles(n int) (fstest.MapFS, map[string]string) {
+	fsys := make(fstest.MapFS)
+	files := make(map[string]string)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("resources/jsc/file%03d.js", i)
+		fsys[name] = &fstest.MapFile{Data: bytes.Repeat([]byte(fmt.Sprintf("var x%03d = %03d;\n", i, i)), 256)}
+		files[fmt.Sprintf("jsc://file%03d.js", i)] = name
+	}
+	return fsys, files
+}
+
+func BenchmarkHashFiles(b *testing.B) {
+	fsys, files := testFiles(500)
+	for _, bm := range []struct {
+		name string
+		jobs int
+	}{{"jobs=1", 1}, {"jobs=NumCPU", runtime.NumCPU()}} {
+		b.Run(bm.name, func(b *testing.B) {
+			opts, err := Options{Jobs: bm.jobs}.withDefaults()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := hashFiles(context.Background(), fsys, "resources/jsc", files, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// recordLogger keeps every log line. It is safe for concurrent use.
+type recordLogger struct {
+	mu    sync.Mutex
+	lines []map[string]interface{}
+}
+
+func (l *recordLogger) Log(keyvals ...interface{}) error {
+	line := make(map[string]interface{})
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		line[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, line)
+	return nil
+}
+
+// TestHashFilesWorkers hashes with several workers logging concurrently, run
+// it with -race. Every file is logged with its worker and the result is the
+// same as with a single worker.
+func TestHashFilesWorkers(t *testing.T) {
+	fsys, files := testFiles(100)
+	hash := func(jobs int, logger *recordLogger) []VersionInfo {
+		t.Helper()
+		opts, err := Options{Jobs: jobs, Logger: logger}.withDefaults()
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos, err := hashFiles(context.Background(), fsys, "resources/jsc", files, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return infos
+	}
+	want := hash(1, new(recordLogger))
+
+	logger := new(recordLogger)
+	got := hash(8, logger)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("hashFiles with 8 jobs = %v, want %v", got, want)
+	}
+	if !sort.SliceIsSorted(got, func(i, j int) bool { return got[i].ResourceName < got[j].ResourceName }) {
+		t.Error("hashFiles with 8 jobs returned the entries out of order")
+	}
+
+	hashed := 0
+	for _, line := range logger.lines {
+		if line["message"] != "hashed" {
+			continue
+		}
+		hashed++
+		if _, ok := line["worker"]; !ok {
+			t.Errorf("log line %v has no worker", line)
+		}
+	}
+	if hashed != len(files) {
+		t.Errorf("%d files logged as hashed, want %d", hashed, len(files))
+	}
+}
@@ -0,0 +1,40 @@
+package manifest
+
+import "sort"
+
+// Change describes a resourceName whose version differs between two
+// manifests. Old or New is empty when the entry only exists on one side.
+type Change struct {
+	Section      string
+	ResourceName string
+	Old          string
+	New          string
+}
+
+// Compare lists the entries that were added, removed or changed going from
+// old to new, section by section.
+func Compare(old, new *Manifest) []Change {
+	var changes []Change
+	oldSections := old.Sections()
+	for i, section := range new.Sections() {
+		before := make(map[string]string)
+		for _, v := range oldSections[i].VersionInfo {
+			before[v.ResourceName] = v.Version
+		}
+		for _, v := range section.VersionInfo {
+			if before[v.ResourceName] != v.Version {
+				changes = append(changes, Change{section.Name, v.ResourceName, before[v.ResourceName], v.Version})
+			}
+			delete(before, v.ResourceName)
+		}
+		removed := make([]string, 0, len(before))
+		for name := range before {
+			removed = append(removed, name)
+		}
+		sort.Strings(removed)
+		for _, name := range removed {
+			changes = append(changes, Change{section.Name, name, before[name], ""})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,219 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// patchable are the descriptor fields that are edited in place in the
+// original file. A change to any other field needs a full rewrite.
+var patchable = []string{"Revision", "Basepaths", "LastModifiedAt", "LastModifiedBy", "ManifestVersion"}
+
+// element is a child of the root element of a descriptor, as byte offsets
+// into the file.
+type element struct {
+	name       string
+	lead       int // start of the whitespace in front of the element
+	start, end int
+	innerStart int
+	innerEnd   int
+}
+
+func (e element) selfClosing() bool {
+	return e.end == e.innerStart
+}
+
+// edit replaces raw[start:end] with text.
+type edit struct {
+	start, end int
+	text       string
+}
+
+// patch returns the original descriptor file with the changes made to b
+// applied in place, so every byte outside the changed elements and attributes
+// is kept. It reports false if b was changed in a way that cannot be patched.
+func (b *Bundle) patch() ([]byte, bool, error) {
+	cur := reflect.ValueOf(b.descriptor()).Elem()
+	orig := reflect.New(cur.Type())
+	if err := xml.Unmarshal(b.raw, orig.Interface()); err != nil {
+		return nil, false, err
+	}
+	rest := reflect.New(cur.Type()).Elem()
+	rest.Set(cur)
+	for _, name := range patchable {
+		if f := rest.FieldByName(name); f.IsValid() {
+			f.Set(orig.Elem().FieldByName(name))
+		}
+	}
+	if !reflect.DeepEqual(rest.Interface(), orig.Elem().Interface()) {
+		return nil, false, nil
+	}
+
+	root, children, err := scanDescriptor(b.raw)
+	if err != nil {
+		return nil, false, err
+	}
+	if bytes.HasSuffix(b.raw[root.start:root.end], []byte("/>")) {
+		return nil, false, nil
+	}
+	order := childOrder(cur.Type())
+	var edits []edit
+	for _, name := range patchable {
+		f := cur.FieldByName(name)
+		if !f.IsValid() || reflect.DeepEqual(f.Interface(), orig.Elem().FieldByName(name).Interface()) {
+			continue
+		}
+		switch name {
+		case "Revision":
+			edits = append(edits, setAttr(b.raw, root, "revision", f.String()))
+		case "Basepaths":
+			edits = append(edits, setList(b.raw, root, children, order, name, f.Interface().([]string))...)
+		default:
+			edits = append(edits, setList(b.raw, root, children, order, name, []string{f.String()})...)
+		}
+	}
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var out bytes.Buffer
+	copied := 0
+	for _, e := range edits {
+		out.Write(b.raw[copied:e.start])
+		out.WriteString(e.text)
+		copied = e.end
+	}
+	out.Write(b.raw[copied:])
+	return out.Bytes(), true, nil
+}
+
+// scanDescriptor returns the start tag of the root element, as start and end,
+// and its children.
+func scanDescriptor(raw []byte) (element, []element, error) {
+	d := xml.NewDecoder(bytes.NewReader(raw))
+	var root element
+	var children []element
+	var cur element
+	depth := 0
+	for {
+		offset := int(d.InputOffset())
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return root, nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch depth {
+			case 1:
+				root = element{name: qualified(t.Name), start: offset, end: int(d.InputOffset())}
+			case 2:
+				cur = element{name: qualified(t.Name), lead: offset, start: offset, innerStart: int(d.InputOffset())}
+				for cur.lead > 0 && strings.ContainsRune(" \t\r\n", rune(raw[cur.lead-1])) {
+					cur.lead--
+				}
+			}
+		case xml.EndElement:
+			if depth == 2 {
+				cur.innerEnd, cur.end = offset, int(d.InputOffset())
+				children = append(children, cur)
+			}
+			depth--
+		}
+	}
+	return root, children, nil
+}
+
+// childOrder returns the names of the child elements of a descriptor type in
+// the order they are declared, which is the order Apigee writes them in.
+func childOrder(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("xml")
+		if f.Name == "XMLName" || strings.Contains(tag, ",") {
+			continue
+		}
+		if tag != "" {
+			names = append(names, tag)
+		} else {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+var attrValue = `\s*=\s*("[^"]*"|'[^']*')`
+
+// setAttr sets the attribute name of the root element.
+func setAttr(raw []byte, root element, name, value string) edit {
+	quoted := `"` + escape(value) + `"`
+	tag := raw[root.start:root.end]
+	if loc := regexp.MustCompile(`\s` + regexp.QuoteMeta(name) + attrValue).FindSubmatchIndex(tag); loc != nil {
+		return edit{root.start + loc[2], root.start + loc[3], quoted}
+	}
+	end := root.end - len(">")
+	return edit{end, end, " " + name + "=" + quoted}
+}
+
+// setList replaces the children called name with one element per value. The
+// new elements take the place of the first existing one or, if there is none,
+// follow the closest preceding sibling in order.
+func setList(raw []byte, root element, children []element, order []string, name string, values []string) []edit {
+	var existing []element
+	for _, c := range children {
+		if c.name == name {
+			existing = append(existing, c)
+		}
+	}
+	if len(existing) == 1 && len(values) == 1 {
+		e := existing[0]
+		if e.selfClosing() {
+			return []edit{{e.start, e.end, "<" + name + ">" + escape(values[0]) + "</" + name + ">"}}
+		}
+		return []edit{{e.innerStart, e.innerEnd, escape(values[0])}}
+	}
+
+	indent := "\n    "
+	if len(children) > 0 {
+		indent = string(raw[children[0].lead:children[0].start])
+	}
+	var text strings.Builder
+	for _, v := range values {
+		text.WriteString(indent + "<" + name + ">" + escape(v) + "</" + name + ">")
+	}
+	if len(existing) > 0 {
+		edits := []edit{{existing[0].lead, existing[0].end, text.String()}}
+		for _, e := range existing[1:] {
+			edits = append(edits, edit{e.lead, e.end, ""})
+		}
+		return edits
+	}
+	at := root.end
+	for _, c := range children {
+		if index(order, c.name) < index(order, name) && c.end > at {
+			at = c.end
+		}
+	}
+	return []edit{{at, at, text.String()}}
+}
+
+func index(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return len(names)
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
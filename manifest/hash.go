@@ -0,0 +1,284 @@
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+var hashAlgorithms = map[string]hashAlgorithm{
+	"sha256": {Name: "SHA-256", New: sha256.New},
+	"sha384": {Name: "SHA-384", New: sha512.New384},
+	"sha512": {Name: "SHA-512", New: sha512.New},
+}
+
+// TextExtensions lists the file extensions whose line endings are normalized
+// with Options.NormalizeEOL. Everything else is hashed byte-exact.
+var TextExtensions = []string{".xml", ".js", ".py", ".wsdl", ".xsd"}
+
+// digestEncodings are the supported Options.DigestEncoding values.
+var digestEncodings = map[string]func([]byte) string{
+	"hex":    hex.EncodeToString,
+	"base64": base64.StdEncoding.EncodeToString,
+}
+
+// AlgorithmName returns the name of the digest algorithm hash, as written in
+// front of digests: SHA-512 for sha512 or "". It returns "" for an unsupported
+// algorithm.
+func AlgorithmName(hash string) string {
+	if hash == "" {
+		hash = "sha512"
+	}
+	return hashAlgorithms[hash].Name
+}
+
+// versionFields are the fields of Options.VersionTemplate.
+type versionFields struct {
+	Algo   string
+	Hash   string
+	Digest string
+}
+
+var versionFuncs = template.FuncMap{"lower": strings.ToLower, "upper": strings.ToUpper}
+
+// version returns the version string for the encoded digest sha.
+func (o Options) version(sha string) string {
+	if o.tmpl == nil {
+		return o.algo.Name + ":" + sha
+	}
+	hash := o.Hash
+	if hash == "" {
+		hash = "sha512"
+	}
+	var b strings.Builder
+	_ = o.tmpl.Execute(&b, versionFields{o.algo.Name, hash, sha}) // checked by withDefaults
+	return b.String()
+}
+
+// hashAlgorithm is a digest usable for version strings. Name is the prefix
+// Apigee expects in front of the encoded digest.
+type hashAlgorithm struct {
+	Name string
+	New  func() hash.Hash
+}
+
+// Version returns the version string for the content of r, for example
+// "SHA-512:<hex digest>", as used for ManifestVersion.
+func Version(r io.Reader, opts Options) (string, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return "", err
+	}
+	sha, err := opts.digest(r)
+	if err != nil {
+		return "", err
+	}
+	return opts.version(sha), nil
+}
+
+// FileVersion returns the version string a manifest entry gets for a file
+// called filename with the content r, applying the same normalization as
+// Generate with opts. Only the extension of filename matters. With
+// opts.HashPath, use ResourceVersion instead.
+func FileVersion(r io.Reader, filename string, opts Options) (string, error) {
+	if opts.HashPath {
+		return "", errors.New("HashPath needs the resourceName of the file")
+	}
+	return ResourceVersion(r, filename, "", opts)
+}
+
+// ResourceVersion is like FileVersion for the manifest entry resourceName,
+// such as AM-1 or jsc://lib/util.js, which is hashed too if opts.HashPath is
+// set.
+func ResourceVersion(r io.Reader, filename, resourceName string, opts Options) (string, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return "", err
+	}
+	sha, err := sumContent(r, filename, opts.forResource(resourceName))
+	if err != nil {
+		return "", err
+	}
+	return opts.version(sha), nil
+}
+
+// Fingerprint returns a single digest over all entries of m, like
+// "SHA-512:<hex digest>". Unlike ManifestVersion, which hashes the serialized
+// manifest.xml, it only depends on the section, name and version of each
+// entry, so it doesn't change with the manifest name or output formatting.
+func Fingerprint(m *Manifest, opts Options) (string, error) {
+	var lines []string
+	for _, section := range m.Sections() {
+		for _, v := range section.VersionInfo {
+			lines = append(lines, section.Name+" "+v.ResourceName+" "+v.Version+"\n")
+		}
+	}
+	sort.Strings(lines)
+	return Version(strings.NewReader(strings.Join(lines, "")), opts)
+}
+
+// sum returns the encoded digest of filename. Errors name the file, so a failure
+// can be traced to the exact entry of the manifest. Waiting to retry a read
+// stops once ctx is done, returning ctx.Err().
+func sum(ctx context.Context, fsys fs.FS, filename string, opts Options) (string, error) {
+	sha, err := sumFile(fsys, filename, opts)
+	for retry := 0; err != nil && retry < opts.ReadRetries && transient(err); retry++ {
+		_ = level.Warn(opts.Logger).Log("message", "retrying read", "file", filename, "err", err)
+		delay := retryDelay << retry
+		if delay > maxRetryDelay || delay <= 0 {
+			delay = maxRetryDelay
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", ctx.Err()
+		case <-timer.C:
+		}
+		sha, err = sumFile(fsys, filename, opts)
+	}
+	var perr *fs.PathError
+	if err != nil && !errors.As(err, &perr) {
+		err = &fs.PathError{Op: "hash", Path: filename, Err: err}
+	}
+	return sha, err
+}
+
+// retryDelay is the wait before the first retry of a failed read. It doubles
+// with every further retry, up to maxRetryDelay.
+const (
+	retryDelay    = 100 * time.Millisecond
+	maxRetryDelay = 2 * time.Second
+)
+
+// transient reports whether err may go away when the read is repeated, which
+// rules out missing files, missing permissions and malformed XML.
+func transient(err error) bool {
+	var perr *fs.PathError
+	if errors.As(err, &perr) && perr.Op == "canonicalize" {
+		return false
+	}
+	return !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission)
+}
+
+func sumFile(fsys fs.FS, filename string, opts Options) (string, error) {
+	f, err := fsys.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// A buffer larger than the file is never filled, so small files don't
+	// allocate the whole ReadBuffer.
+	size := opts.ReadBuffer
+	if fi, err := f.Stat(); err == nil && fi.Size() < int64(size) {
+		size = int(fi.Size()) + 1
+	}
+	// Hiding the WriteTo of the file makes the bufio.Reader do the reads.
+	return sumContent(bufio.NewReaderSize(struct{ io.Reader }{f}, size), filename, opts)
+}
+
+// defaultReadBuffer is the default of Options.ReadBuffer.
+const defaultReadBuffer = 64 << 10
+
+// sumContent hashes r as the content of filename, whose extension selects
+// the normalization.
+func sumContent(r io.Reader, filename string, opts Options) (string, error) {
+	if opts.CanonicalXML && strings.HasSuffix(filename, ".xml") {
+		c, err := canonicalXML(r)
+		if err != nil {
+			return "", &fs.PathError{Op: "canonicalize", Path: filename, Err: err}
+		}
+		return opts.digest(bytes.NewReader(c))
+	}
+	if opts.NormalizeEOL && isText(filename) {
+		c, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+		c = bytes.ReplaceAll(c, []byte("\r\n"), []byte("\n"))
+		return opts.digest(bytes.NewReader(c))
+	}
+	return opts.digest(r)
+}
+
+// forResource returns the options to hash the file of the entry
+// resourceName with: with HashPath, the name goes in front of the content.
+func (o Options) forResource(resourceName string) Options {
+	if o.HashPath {
+		// The NUL ends the name, no resourceName contains one.
+		o.HashPrefix += resourceName + "\x00"
+	}
+	return o
+}
+
+// digest returns the encoded digest of r, with opts.HashPrefix hashed first.
+func (o Options) digest(r io.Reader) (string, error) {
+	if o.HashPrefix != "" {
+		r = io.MultiReader(strings.NewReader(o.HashPrefix), r)
+	}
+	return sumReader(r, o.algo, o.encode)
+}
+
+// verifySidecar checks filename against the SHA-512 digest recorded in
+// filename.sha512, if that exists. The sidecar holds the hex digest, optionally
+// followed by the file name as written by sha512sum.
+func verifySidecar(fsys fs.FS, filename string) error {
+	c, err := fs.ReadFile(fsys, filename+".sha512")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(c))
+	if len(fields) == 0 {
+		return &fs.PathError{Op: "verify", Path: filename + ".sha512", Err: errors.New("empty sidecar")}
+	}
+	f, err := fsys.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sha, err := sumReader(f, hashAlgorithms["sha512"], hex.EncodeToString)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sha, fields[0]) {
+		return &fs.PathError{Op: "verify", Path: filename, Err: errors.New("content does not match " + path.Base(filename) + ".sha512")}
+	}
+	return nil
+}
+
+func isText(filename string) bool {
+	for _, ext := range TextExtensions {
+		if strings.HasSuffix(filename, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func sumReader(r io.Reader, algo hashAlgorithm, encode func([]byte) string) (string, error) {
+	h := algo.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return encode(h.Sum(nil)), nil
+}
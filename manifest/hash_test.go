@@ -0,0 +1,114 @@
+package manifest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+var errReadFailed = errors.New("read failed")
+
+// failFS is a MapFS whose file fail can be opened but not read.
+type failFS struct {
+	fstest.MapFS
+	fail string
+}
+
+func (f failFS) Open(name string) (fs.File, error) {
+	file, err := f.MapFS.Open(name)
+	if err != nil || name != f.fail {
+		return file, err
+	}
+	return failingFile{file}, nil
+}
+
+type failingFile struct {
+	fs.File
+}
+
+func (failingFile) Read([]byte) (int, error) {
+	return 0, errReadFailed
+}
+
+func TestSumErrorNamesPath(t *testing.T) {
+	fsys := failFS{
+		MapFS: fstest.MapFS{
+			"p1.xml":            {Data: []byte(`<APIProxy name="p1"/>`)},
+			"policies/AM-1.xml": {Data: []byte(`<AssignMessage name="AM-1"/>`)},
+			"policies/AM-2.xml": {Data: []byte(`<AssignMessage name="AM-2"/>`)},
+		},
+		fail: "policies/AM-2.xml",
+	}
+	_, err := GenerateFS(fsys, Options{})
+	if err == nil {
+		t.Fatal("GenerateFS succeeded, want an error")
+	}
+	var perr *fs.PathError
+	if !errors.As(err, &perr) {
+		t.Fatalf("GenerateFS error %v (%T) is not a *fs.PathError", err, err)
+	}
+	if perr.Op != "hash" || perr.Path != "policies/AM-2.xml" {
+		t.Errorf("error op, path = %q, %q, want hash, policies/AM-2.xml", perr.Op, perr.Path)
+	}
+	if !errors.Is(err, errReadFailed) {
+		t.Errorf("error %v doesn't wrap the read error", err)
+	}
+	if !strings.Contains(err.Error(), "policies/AM-2.xml") {
+		t.Errorf("error %q doesn't name the file", err)
+	}
+}
+
+// TestSumRetryCanceled checks that sum stops waiting to retry a failing read
+// once its context is done.
+func TestSumRetryCanceled(t *testing.T) {
+	fsys := failFS{
+		MapFS: fstest.MapFS{"policies/AM-1.xml": {Data: []byte(`<AssignMessage name="AM-1"/>`)}},
+		fail:  "policies/AM-1.xml",
+	}
+	opts, err := Options{ReadRetries: 10}.withDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := sum(ctx, fsys, "policies/AM-1.xml", opts); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("sum error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("sum returned after %v, want soon after the deadline", d)
+	}
+}
+
+// BenchmarkSum hashes many small files one after another, as a bundle full
+// of policies does, with different read buffer sizes.
+func BenchmarkSum(b *testing.B) {
+	fsys := make(fstest.MapFS)
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = fmt.Sprintf("policies/AM-%03d.xml", i)
+		fsys[names[i]] = &fstest.MapFile{Data: []byte(fmt.Sprintf(`<AssignMessage name="AM-%03d"><AssignVariable><Name>v</Name><Value>%03d</Value></AssignVariable></AssignMessage>`, i, i))}
+	}
+	for _, size := range []int{4 << 10, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("buffer=%dKiB", size>>10), func(b *testing.B) {
+			opts, err := Options{ReadBuffer: size}.withDefaults()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, name := range names {
+					if _, err := sum(context.Background(), fsys, name, opts); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package manifest
+
+import (
+	"errors"
+	"io/fs"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile is read from the bundle folder. It holds gitignore-style
+// patterns of files to leave out of the manifest, on top of Options.Exclude.
+const IgnoreFile = ".apiproxyignore"
+
+// ignoreRule is one line of an IgnoreFile.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool // the line starts with !, so matches are included again
+	dirOnly bool // the line ends with /, so it only matches directories
+}
+
+// ignoreRules are the rules of an IgnoreFile in file order. Like in
+// .gitignore, the last rule matching a path decides.
+type ignoreRules []ignoreRule
+
+// loadIgnore reads the IgnoreFile of fsys. A missing file yields no rules.
+func loadIgnore(fsys fs.FS) (ignoreRules, error) {
+	c, err := fs.ReadFile(fsys, IgnoreFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rules ignoreRules
+	for _, line := range strings.Split(string(c), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r ignoreRule
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, `\`)
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		r.re = regexp.MustCompile(globRegexp(line))
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// globRegexp translates a pattern to a regular expression for slash separated
+// paths relative to the bundle folder. A pattern without a slash matches in
+// any directory, * and ? don't match a slash, and ** matches across
+// directories.
+func globRegexp(pattern string) string {
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// ignored reports whether the file or directory p is left out. Everything
+// below an ignored directory is left out, a negation can't include it again.
+func (r ignoreRules) ignored(p string, isDir bool) bool {
+	if len(r) == 0 {
+		return false
+	}
+	parts := strings.Split(p, "/")
+	for i := 1; i < len(parts); i++ {
+		if r.match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return r.match(p, isDir)
+}
+
+func (r ignoreRules) match(p string, isDir bool) bool {
+	ignored := false
+	for _, rule := range r {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(p) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,505 @@
+// Package manifest computes the manifest of an Apigee API proxy or shared
+// flow bundle, i.e. the digest of every policy, endpoint and resource file.
+//
+// All bundle files are read through an fs.FS. Generate and FindBundle use
+// os.DirFS for a folder on disk; GenerateFS and FindBundleFS accept any
+// fs.FS, such as a zip archive or a testing/fstest.MapFS.
+package manifest
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Options controls how a bundle is hashed. The zero value hashes with SHA-512
+// using the standard bundle layout.
+type Options struct {
+	// Name is the name attribute of the manifest. Empty uses the name of an
+	// API proxy, or "manifest" for a shared flow or a proxy without a name.
+	Name string
+	// Hash names the digest algorithm: sha512 (default), sha256 or sha384.
+	Hash string
+	// DigestEncoding is how digests are written after the algorithm prefix:
+	// hex (default), as Apigee writes them, or base64. It applies to every
+	// version string, including ManifestVersion.
+	DigestEncoding string
+	// HashPrefix, if not empty, is hashed in front of the content of every
+	// file and of the manifest. The digests are then namespaced: they no
+	// longer match the plain digests of the files, as computed by sha512sum
+	// or Apigee, and only match digests computed with the same prefix.
+	HashPrefix string
+	// HashPath hashes the resourceName of every file in front of its
+	// content, so the version of a file changes when it is moved or renamed.
+	// The versions don't match those of path-agnostic hashing, as done by
+	// Apigee, and only match versions computed with HashPath as well.
+	HashPath bool
+	// VersionTemplate is a text/template for version strings, applied to
+	// every file and to ManifestVersion. It gets .Algo (SHA-512), .Hash
+	// (sha512) and .Digest, and the functions lower and upper. Empty means
+	// "{{.Algo}}:{{.Digest}}", the format Apigee writes.
+	VersionTemplate string
+	// Jobs is the number of files hashed concurrently, runtime.NumCPU() if zero.
+	Jobs int
+	// NormalizeEOL hashes CRLF line endings as LF in TextExtensions files.
+	NormalizeEOL bool
+	// CanonicalXML hashes .xml files in a canonical form, with sorted
+	// attributes and without insignificant whitespace. The digests differ
+	// from those of the raw bytes.
+	CanonicalXML bool
+	// FollowSymlinks hashes the targets of symlinks below the resources
+	// directory. Otherwise they are skipped with a warning.
+	FollowSymlinks bool
+	// VerifySidecars checks every resource file that has a <name>.sha512
+	// sibling against the SHA-512 digest recorded there. The sidecars
+	// themselves are then left out of the manifest.
+	VerifySidecars bool
+	// NaturalSort orders resource names with embedded numbers numerically.
+	NaturalSort bool
+	// StrictXML fails on any .xml file in the policies, proxies, targets or
+	// sharedflows directory that is not well-formed, instead of hashing it.
+	StrictXML bool
+	// IncludeSize records the size of every file in VersionInfo.Size. It
+	// changes the manifest and therefore the ManifestVersion.
+	IncludeSize bool
+	// ReadRetries is how often reading a file is retried, with a growing
+	// delay of up to two seconds, before a read error is returned. It helps
+	// with transient errors on network mounts.
+	ReadRetries int
+	// FailOnZeroByte makes an empty file an error. Otherwise it is hashed
+	// and a warning is logged.
+	FailOnZeroByte bool
+	// ReadBuffer is the size in bytes of the buffer files are read through
+	// while hashing, 64 KiB if zero. Smaller files get a buffer of their
+	// size. Files are streamed, never read whole, unless NormalizeEOL or
+	// CanonicalXML apply to them.
+	ReadBuffer int
+	// FailFast stops at the first problem. Otherwise every section is
+	// collected and all problems are returned together as Errors.
+	FailFast bool
+	// MaxFileSize, if positive, is the largest file size in bytes that is
+	// hashed. A larger file fails the generation before any file of its
+	// directory is read. Files of directories collected earlier may have been
+	// hashed by then.
+	MaxFileSize int64
+	// Exclude holds filepath.Match patterns. Files whose base name matches
+	// any of them are left out of the manifest entirely.
+	Exclude []string
+	// ResourceExts, if not empty, limits the resources to files with
+	// one of these extensions, given with or without the leading dot and
+	// matched regardless of case. Exclude still applies to them.
+	ResourceExts []string
+	// Logger receives a debug line for every hashed file, with the worker
+	// that hashed it. Nil discards them. With more than one job it is called
+	// concurrently, so its writer must be safe for that, for example one
+	// wrapped with log.NewSyncWriter.
+	Logger log.Logger
+	// Progress, if set, is called after each file with the number of files
+	// done and the total in the directory being hashed. Calls don't overlap.
+	Progress func(dir string, done, total int)
+	// Cache, if set, supplies the digests of files unchanged since it was
+	// filled. Entries from runs with a different Hash, NormalizeEOL,
+	// CanonicalXML, DigestEncoding, HashPrefix or HashPath are ignored.
+	Cache *Cache
+	// Transform, if set, is called with the finished manifest before it is
+	// returned, so it runs before anything validates, fingerprints or
+	// serializes it. It may change the manifest in place, for example to
+	// add or rename entries; an error fails the generation.
+	Transform func(*Manifest) error
+
+	// ResourceRoots are further directories, relative to the bundle folder,
+	// laid out like resources. Their files are merged into the Resources
+	// section; a resource name found in two places is an error.
+	ResourceRoots []string
+
+	// ResourceMap maps resource type directory names to the scheme used in
+	// resource names, e.g. "scripts" to "jsc" for resources/scripts/a.js to
+	// become jsc://a.js. Unmapped directories use their own name.
+	ResourceMap map[string]string
+
+	// Directory overrides, relative to the bundle folder. Empty values use
+	// the standard policies, proxies, targets, resources and sharedflows.
+	PoliciesDir    string
+	ProxiesDir     string
+	TargetsDir     string
+	ResourcesDir   string
+	SharedFlowsDir string
+
+	algo   hashAlgorithm
+	encode func([]byte) string
+	ignore ignoreRules // from the IgnoreFile of the bundle
+	tmpl   *template.Template
+}
+
+// Validate reports whether the options can be used for Generate.
+func (o Options) Validate() error {
+	_, err := o.withDefaults()
+	return err
+}
+
+func (o Options) withDefaults() (Options, error) {
+	name := o.Hash
+	if name == "" {
+		name = "sha512"
+	}
+	algo, ok := hashAlgorithms[name]
+	if !ok {
+		return o, fmt.Errorf("unsupported hash algorithm %s", o.Hash)
+	}
+	o.algo = algo
+	if o.VersionTemplate != "" {
+		tmpl, err := template.New("version").Funcs(versionFuncs).Option("missingkey=error").Parse(o.VersionTemplate)
+		if err == nil {
+			err = tmpl.Execute(ioutil.Discard, versionFields{algo.Name, name, ""})
+		}
+		if err != nil {
+			return o, fmt.Errorf("bad version template: %w", err)
+		}
+		o.tmpl = tmpl
+	}
+	if o.ReadBuffer <= 0 {
+		o.ReadBuffer = defaultReadBuffer
+	}
+	encoding := o.DigestEncoding
+	if encoding == "" {
+		encoding = "hex"
+	}
+	encode, ok := digestEncodings[encoding]
+	if !ok {
+		return o, fmt.Errorf("unsupported digest encoding %s", o.DigestEncoding)
+	}
+	o.encode = encode
+	for _, pattern := range o.Exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return o, fmt.Errorf("bad exclude pattern %q: %w", pattern, err)
+		}
+	}
+	if o.Jobs < 1 {
+		o.Jobs = runtime.NumCPU()
+	}
+	if o.Logger == nil {
+		o.Logger = log.NewNopLogger()
+	}
+	return o, nil
+}
+
+// resourceAllowed reports whether a resource file called name has one of
+// o.ResourceExts.
+func (o Options) resourceAllowed(name string) bool {
+	if len(o.ResourceExts) == 0 {
+		return true
+	}
+	for _, ext := range o.ResourceExts {
+		if strings.EqualFold(path.Ext(name), "."+strings.TrimPrefix(ext, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipped reports whether the file or directory at p, relative to the bundle
+// folder, is left out by Exclude or by the IgnoreFile.
+func (o Options) skipped(p string, isDir bool) bool {
+	return o.excluded(path.Base(p)) || o.ignore.ignored(p, isDir)
+}
+
+func (o Options) excluded(name string) bool {
+	for _, pattern := range o.Exclude {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (o Options) dir(override, name string) string {
+	if override != "" {
+		return filepath.ToSlash(override)
+	}
+	return name
+}
+
+// Dirs returns the directories, relative to the bundle folder and separated
+// by slashes, whose files Generate hashes with o: the standard directories
+// or their overrides, followed by ResourceRoots.
+func (o Options) Dirs() []string {
+	dirs := []string{
+		o.dir(o.PoliciesDir, "policies"),
+		o.dir(o.ProxiesDir, "proxies"),
+		o.dir(o.TargetsDir, "targets"),
+		o.dir(o.ResourcesDir, "resources"),
+		o.dir(o.SharedFlowsDir, "sharedflows"),
+	}
+	for _, root := range o.ResourceRoots {
+		dirs = append(dirs, filepath.ToSlash(root))
+	}
+	return dirs
+}
+
+// Generate hashes the bundle in folder and returns its manifest. The folder
+// is the apiproxy or sharedflowbundle directory holding the main descriptor.
+func Generate(folder string, opts Options) (*Manifest, error) {
+	return GenerateContext(context.Background(), folder, opts)
+}
+
+// GenerateContext is like Generate but stops between files once ctx is done,
+// returning ctx.Err().
+func GenerateContext(ctx context.Context, folder string, opts Options) (*Manifest, error) {
+	doc, err := GenerateFSContext(ctx, os.DirFS(folder), opts)
+	return doc, inFolder(folder, err)
+}
+
+// inFolder makes the path of a *fs.PathError from os.DirFS(folder), which is
+// relative to folder, usable outside of it again.
+func inFolder(folder string, err error) error {
+	if errs, ok := err.(Errors); ok {
+		for _, err := range errs {
+			inFolder(folder, err)
+		}
+		return errs
+	}
+	var perr *fs.PathError
+	if errors.As(err, &perr) && !strings.HasPrefix(perr.Path, folder+string(filepath.Separator)) {
+		perr.Path = filepath.Join(folder, filepath.FromSlash(perr.Path))
+	}
+	return err
+}
+
+// Errors holds every problem found by a generation without
+// Options.FailFast, in the order the sections are collected. Error returns
+// them one per line, and errors.Is and errors.As look at each of them.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap returns the problems, for errors.Is and errors.As.
+func (e Errors) Unwrap() []error {
+	return e
+}
+
+// GenerateFS is like Generate for a bundle folder exposed as fsys, such as a
+// directory inside a zip archive.
+func GenerateFS(fsys fs.FS, opts Options) (*Manifest, error) {
+	return GenerateFSContext(context.Background(), fsys, opts)
+}
+
+// GenerateFSContext is like GenerateFS but stops between files once ctx is
+// done, returning ctx.Err().
+func GenerateFSContext(ctx context.Context, fsys fs.FS, opts Options) (*Manifest, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := FindBundleFS(fsys)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ignore, err = loadIgnore(fsys); err != nil {
+		return nil, err
+	}
+	if opts.Cache != nil {
+		// Every option that changes digests belongs in the setting, and in
+		// the documentation of Options.Cache.
+		setting := fmt.Sprintf("%s normalize-eol=%t canonical-xml=%t", opts.algo.Name, opts.NormalizeEOL, opts.CanonicalXML)
+		if opts.DigestEncoding != "" && opts.DigestEncoding != "hex" {
+			setting += " digest-encoding=" + opts.DigestEncoding
+		}
+		if opts.HashPrefix != "" {
+			// The prefix may be a secret, so only its digest is recorded.
+			setting += fmt.Sprintf(" hash-prefix=%x", sha256.Sum256([]byte(opts.HashPrefix)))
+		}
+		if opts.HashPath {
+			setting += " hash-path=true"
+		}
+		opts.Cache.reset(setting)
+	}
+
+	doc := new(Manifest)
+	doc.Name = opts.Name
+	if doc.Name == "" && bundle.APIProxy != nil {
+		doc.Name = bundle.APIProxy.Name
+	}
+	if doc.Name == "" {
+		doc.Name = "manifest"
+	}
+	var errs Errors
+	// report records err and returns it if generation has to stop there.
+	report := func(err error) error {
+		if e, ok := err.(Errors); ok {
+			errs = append(errs, e...)
+		} else {
+			errs = append(errs, err)
+		}
+		if opts.FailFast || ctx.Err() != nil {
+			return err
+		}
+		return nil
+	}
+	{
+		dir := opts.dir(opts.PoliciesDir, "policies")
+		policies, err := calculateAll(ctx, fsys, dir, stripSuffix("xml"), opts)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			if err := report(err); err != nil {
+				return nil, err
+			}
+		}
+		doc.Policies.VersionInfo = policies
+	}
+	if bundle.SharedFlow != nil {
+		dir := opts.dir(opts.SharedFlowsDir, "sharedflows")
+		sharedflows, err := calculateAll(ctx, fsys, dir, stripSuffix("xml"), opts)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			if err := report(err); err != nil {
+				return nil, err
+			}
+		}
+		doc.SharedFlows.VersionInfo = sharedflows
+	}
+	if bundle.APIProxy != nil {
+		dir := opts.dir(opts.ProxiesDir, "proxies")
+		proxies, err := calculateAll(ctx, fsys, dir, stripSuffix("xml"), opts)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			if err := report(err); err != nil {
+				return nil, err
+			}
+		}
+		doc.ProxyEndpoints.VersionInfo = proxies
+	}
+	if bundle.APIProxy != nil {
+		dir := opts.dir(opts.TargetsDir, "targets")
+		targets, err := calculateAll(ctx, fsys, dir, stripSuffix("xml"), opts)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			if err := report(err); err != nil {
+				return nil, err
+			}
+		}
+		doc.TargetEndpoints.VersionInfo = targets
+	}
+	seen := make(map[string]string)
+	for i, dir := range append([]string{opts.dir(opts.ResourcesDir, "resources")}, opts.ResourceRoots...) {
+		dir = path.Clean(filepath.ToSlash(dir))
+		resourceDir, err := fs.ReadDir(fsys, dir)
+		if err != nil && (i > 0 || !errors.Is(err, fs.ErrNotExist)) {
+			if err := report(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		for _, d := range resourceDir {
+			if opts.skipped(path.Join(dir, d.Name()), d.IsDir()) {
+				continue
+			}
+			if !d.IsDir() {
+				if err := report(fmt.Errorf("%s/%s: resources must be placed in a type directory", dir, d.Name())); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			scheme := d.Name()
+			if mapped, ok := opts.ResourceMap[scheme]; ok {
+				scheme = mapped
+			}
+			resources, err := calculateTree(ctx, fsys, path.Join(dir, d.Name()), scheme, opts)
+			if err != nil {
+				if err := report(err); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			for _, r := range resources {
+				if other, ok := seen[r.ResourceName]; ok {
+					if err := report(fmt.Errorf("resource name %s is used in both %s and %s/%s", r.ResourceName, other, dir, d.Name())); err != nil {
+						return nil, err
+					}
+				}
+				seen[r.ResourceName] = dir + "/" + d.Name()
+			}
+			doc.Resources.VersionInfo = append(doc.Resources.VersionInfo, resources...)
+		}
+	}
+	switch len(errs) {
+	case 0:
+	case 1:
+		return nil, errs[0]
+	default:
+		return nil, errs
+	}
+	if opts.Transform != nil {
+		if err := opts.Transform(doc); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// Manifest is the content of manifests/manifest.xml. The field order is the
+// serialization order and matches the manifests Apigee exports, sections in
+// alphabetical order, so don't reorder the fields.
+type Manifest struct {
+	Name     string `xml:"name,attr" json:"name"`
+	Policies struct {
+		VersionInfo []VersionInfo `json:"versionInfo"`
+	} `json:"policies"`
+	ProxyEndpoints struct {
+		VersionInfo []VersionInfo `json:"versionInfo"`
+	} `json:"proxyEndpoints"`
+	Resources struct {
+		VersionInfo []VersionInfo `json:"versionInfo"`
+	} `json:"resources"`
+	SharedFlows struct {
+		VersionInfo []VersionInfo `json:"versionInfo"`
+	} `json:"sharedFlows"`
+	TargetEndpoints struct {
+		VersionInfo []VersionInfo `json:"versionInfo"`
+	} `json:"targetEndpoints"`
+}
+
+// Section is one named VersionInfo list of a Manifest.
+type Section struct {
+	Name        string
+	VersionInfo []VersionInfo
+}
+
+// Sections returns the manifest sections in serialization order.
+func (m *Manifest) Sections() []Section {
+	return []Section{
+		{"Policies", m.Policies.VersionInfo},
+		{"ProxyEndpoints", m.ProxyEndpoints.VersionInfo},
+		{"Resources", m.Resources.VersionInfo},
+		{"SharedFlows", m.SharedFlows.VersionInfo},
+		{"TargetEndpoints", m.TargetEndpoints.VersionInfo},
+	}
+}
+
+type VersionInfo struct {
+	ResourceName string `xml:"resourceName,attr" json:"resourceName"`
+	Version      string `xml:"version,attr" json:"version"`
+	// Size is the file size in bytes, only set with Options.IncludeSize.
+	// Empty files get a size of 0, so nil always means not recorded.
+	Size *int64 `xml:"size,attr,omitempty" json:"size,omitempty"`
+}
+
+// equal reports whether v and o record the same file, including its size.
+func (v VersionInfo) equal(o VersionInfo) bool {
+	if v.ResourceName != o.ResourceName || v.Version != o.Version || (v.Size == nil) != (o.Size == nil) {
+		return false
+	}
+	return v.Size == nil || *v.Size == *o.Size
+}
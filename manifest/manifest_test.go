@@ -0,0 +1,58 @@
+package manifest
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+// TestErrorsUnwrap checks that errors.Is and errors.As find every problem
+// collected without FailFast, not only the first.
+func TestErrorsUnwrap(t *testing.T) {
+	fsys := failFS{
+		MapFS: fstest.MapFS{
+			"p1.xml":             {Data: []byte(`<APIProxy name="p1"/>`)},
+			"policies/AM-1.xml":  {Data: []byte{}},
+			"resources/jsc/a.js": {Data: []byte("var a = 1;\n")},
+		},
+		fail: "resources/jsc/a.js",
+	}
+	_, err := GenerateFS(fsys, Options{FailOnZeroByte: true})
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("GenerateFS error %v, want two problems", err)
+	}
+	if !errors.Is(err, errReadFailed) {
+		t.Errorf("errors.Is(%v, errReadFailed) = false, want true", err)
+	}
+	var perr *fs.PathError
+	if !errors.As(err, &perr) || perr.Path != "policies/AM-1.xml" {
+		t.Errorf("errors.As(%v) found %v, want the error of policies/AM-1.xml", err, perr)
+	}
+}
+
+func TestManifestName(t *testing.T) {
+	proxy := fstest.MapFS{"p1.xml": {Data: []byte(`<APIProxy name="p1"/>`)}}
+	flow := fstest.MapFS{"sf1.xml": {Data: []byte(`<SharedFlowBundle name="sf1"/>`)}}
+	tests := []struct {
+		fsys fs.FS
+		name string
+		want string
+	}{
+		{proxy, "", "p1"},
+		{proxy, "custom", "custom"},
+		{fstest.MapFS{"p1.xml": {Data: []byte(`<APIProxy/>`)}}, "", "manifest"},
+		{flow, "", "manifest"},
+		{flow, "custom", "custom"},
+	}
+	for _, tt := range tests {
+		doc, err := GenerateFS(tt.fsys, Options{Name: tt.name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.Name != tt.want {
+			t.Errorf("Name %q: manifest name = %q, want %q", tt.name, doc.Name, tt.want)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Declaration selects the XML declaration in front of written XML files.
+type Declaration string
+
+const (
+	// DefaultDeclaration is the declaration Apigee writes itself.
+	DefaultDeclaration Declaration = "default"
+	// NoStandaloneDeclaration declares standalone="no".
+	NoStandaloneDeclaration Declaration = "no-standalone"
+	// NoDeclaration omits the declaration.
+	NoDeclaration Declaration = "none"
+)
+
+// ParseDeclaration returns the Declaration named s.
+func ParseDeclaration(s string) (Declaration, error) {
+	switch d := Declaration(s); d {
+	case DefaultDeclaration, NoStandaloneDeclaration, NoDeclaration:
+		return d, nil
+	}
+	return "", fmt.Errorf("unsupported XML declaration %s", s)
+}
+
+// header returns the declaration line, including its newline.
+func (d Declaration) header() string {
+	switch d {
+	case NoStandaloneDeclaration:
+		return `<?xml version="1.0" encoding="UTF-8" standalone="no"?>` + "\n"
+	case NoDeclaration:
+		return ""
+	}
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n"
+}
+
+// Format controls the layout of written XML files. The zero value matches
+// the files Apigee writes.
+type Format struct {
+	// Declaration is the XML declaration, DefaultDeclaration if empty.
+	Declaration Declaration
+	// ExpandEmpty writes empty elements as <a></a> instead of <a/>.
+	ExpandEmpty bool
+	// FullRewrite serializes a descriptor from scratch instead of editing
+	// the original file in place.
+	FullRewrite bool
+	// Comment is written as an XML comment after the declaration of a
+	// manifest, if not empty. Descriptors don't get it.
+	Comment string
+	// OmitEmpty leaves manifest sections without entries out entirely,
+	// instead of writing them as empty elements.
+	OmitEmpty bool
+	// SortAttrs writes the attributes of every element in alphabetical
+	// order instead of the order of the struct fields.
+	SortAttrs bool
+	// Indent is written once per nesting level in front of every element,
+	// four spaces if empty. See ParseIndent.
+	Indent string
+}
+
+// ParseIndent returns the Indent named s: a number of spaces from 1 to 8 or
+// "tab".
+func ParseIndent(s string) (string, error) {
+	if s == "tab" {
+		return "\t", nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 1 && n <= 8 {
+		return strings.Repeat(" ", n), nil
+	}
+	return "", fmt.Errorf("unsupported indentation %s, want 1 to 8 spaces or tab", s)
+}
+
+// WriteManifest writes m to w as manifest.xml content, including the XML
+// declaration and a trailing newline. The output is parsed again before it is
+// written, so a serialization bug fails here instead of producing a corrupt
+// manifest.
+func WriteManifest(m *Manifest, w io.Writer) error {
+	return WriteManifestFormat(m, w, Format{})
+}
+
+// WriteManifestFormat is like WriteManifest with the layout f.
+func WriteManifestFormat(m *Manifest, w io.Writer, f Format) error {
+	if strings.Contains(f.Comment, "--") || strings.HasSuffix(f.Comment, "-") {
+		return fmt.Errorf("comment %q is not allowed in XML", f.Comment)
+	}
+	var v interface{} = m
+	if f.OmitEmpty {
+		v = compact(m)
+	}
+	xm, err := marshal(v, f)
+	if err != nil {
+		return err
+	}
+	if err := roundTrip(m, xm); err != nil {
+		return err
+	}
+	header := f.Declaration.header()
+	if f.Comment != "" {
+		header += "<!-- " + f.Comment + " -->\n"
+	}
+	_, err = io.WriteString(w, header+string(xm)+"\n")
+	return err
+}
+
+// compactManifest is a Manifest that leaves out empty sections, see
+// Format.OmitEmpty. encoding/xml can't omit empty structs, but it omits nil
+// pointers.
+type compactManifest struct {
+	XMLName         xml.Name `xml:"Manifest"`
+	Name            string   `xml:"name,attr"`
+	Policies        *section `xml:",omitempty"`
+	ProxyEndpoints  *section `xml:",omitempty"`
+	Resources       *section `xml:",omitempty"`
+	SharedFlows     *section `xml:",omitempty"`
+	TargetEndpoints *section `xml:",omitempty"`
+}
+
+type section struct {
+	VersionInfo []VersionInfo
+}
+
+func compact(m *Manifest) *compactManifest {
+	list := func(v []VersionInfo) *section {
+		if len(v) == 0 {
+			return nil
+		}
+		return &section{v}
+	}
+	return &compactManifest{
+		Name:            m.Name,
+		Policies:        list(m.Policies.VersionInfo),
+		ProxyEndpoints:  list(m.ProxyEndpoints.VersionInfo),
+		Resources:       list(m.Resources.VersionInfo),
+		SharedFlows:     list(m.SharedFlows.VersionInfo),
+		TargetEndpoints: list(m.TargetEndpoints.VersionInfo),
+	}
+}
+
+// roundTrip checks that xm unmarshals to the same entries as m.
+func roundTrip(m *Manifest, xm []byte) error {
+	var back Manifest
+	if err := xml.Unmarshal(xm, &back); err != nil {
+		return fmt.Errorf("generated manifest does not parse: %w", err)
+	}
+	if back.Name != m.Name {
+		return fmt.Errorf("generated manifest has name %q instead of %q", back.Name, m.Name)
+	}
+	sections := back.Sections()
+	for i, section := range m.Sections() {
+		if len(sections[i].VersionInfo) != len(section.VersionInfo) {
+			return fmt.Errorf("generated manifest has %d %s entries instead of %d", len(sections[i].VersionInfo), section.Name, len(section.VersionInfo))
+		}
+		for j, v := range section.VersionInfo {
+			if !sections[i].VersionInfo[j].equal(v) {
+				return fmt.Errorf("generated manifest has a different %s entry %s", section.Name, v.ResourceName)
+			}
+		}
+	}
+	return nil
+}
+
+// WriteManifestJSON writes m to w as indented JSON. Empty sections are
+// emitted as [] rather than null so consumers always see the same shape.
+func WriteManifestJSON(m *Manifest, w io.Writer) error {
+	out := *m
+	for _, v := range []*[]VersionInfo{
+		&out.Policies.VersionInfo,
+		&out.ProxyEndpoints.VersionInfo,
+		&out.Resources.VersionInfo,
+		&out.SharedFlows.VersionInfo,
+		&out.TargetEndpoints.VersionInfo,
+	} {
+		if *v == nil {
+			*v = []VersionInfo{}
+		}
+	}
+	js, err := json.MarshalIndent(&out, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(js, '\n'))
+	return err
+}
+
+func writeXML(w io.Writer, v interface{}, f Format) error {
+	xm, err := marshal(v, f)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, f.Declaration.header()+string(xm)+"\n")
+	return err
+}
+
+func marshal(v interface{}, f Format) ([]byte, error) {
+	indent := f.Indent
+	if indent == "" {
+		indent = "    "
+	}
+	xm, err := xml.MarshalIndent(v, "", indent)
+	if err == nil && !f.ExpandEmpty {
+		xm, err = selfClose(xm) // https://github.com/golang/go/issues/21399
+	}
+	if err == nil && f.SortAttrs {
+		xm, err = sortAttrs(xm)
+	}
+	return xm, err
+}
+
+var attr = regexp.MustCompile(`\s+[^\s=/>]+\s*=\s*("[^"]*"|'[^']*')`)
+
+// sortAttrs rewrites every start tag of xm with its attributes in
+// alphabetical order. Tags without attributes and everything outside of start
+// tags, including the /> of self-closing ones, are copied unchanged.
+func sortAttrs(xm []byte) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(xm))
+	var out bytes.Buffer
+	copied := 0
+	for {
+		start := int(d.InputOffset())
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		t, ok := tok.(xml.StartElement)
+		if !ok || len(t.Attr) < 2 {
+			continue
+		}
+		tag := xm[start:d.InputOffset()]
+		locs := attr.FindAllIndex(tag, -1)
+		attrs := make([]string, len(locs))
+		for i, loc := range locs {
+			attrs[i] = " " + strings.TrimSpace(string(tag[loc[0]:loc[1]]))
+		}
+		sort.Strings(attrs)
+		out.Write(xm[copied : start+locs[0][0]])
+		out.WriteString(strings.Join(attrs, ""))
+		copied = start + locs[len(locs)-1][1]
+	}
+	out.Write(xm[copied:])
+	return out.Bytes(), nil
+}
+
+// selfClose rewrites elements without any content, <a></a>, to <a/>. It works
+// on the token stream, so character data that merely looks like an end tag is
+// never touched.
+func selfClose(xm []byte) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(xm))
+	var out bytes.Buffer
+	copied := 0
+	openEnd := int64(-1) // offset just past a start tag that nothing followed yet
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tok.(type) {
+		case xml.StartElement:
+			openEnd = d.InputOffset()
+			continue
+		case xml.EndElement:
+			if openEnd >= 0 && d.InputOffset() > openEnd {
+				out.Write(xm[copied : openEnd-1])
+				out.WriteString("/>")
+				copied = int(d.InputOffset())
+			}
+		}
+		openEnd = -1
+	}
+	out.Write(xm[copied:])
+	return out.Bytes(), nil
+}
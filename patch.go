@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// patchSource is a bundle folder that is never written to. Save prints the
+// changes as a unified diff for git apply instead, see -patch. Digests aren't
+// cached either, since the folder may be read-only.
+type patchSource struct {
+	source
+	w io.Writer
+}
+
+func (p patchSource) Save(files []output) error {
+	for _, file := range files {
+		old, err := p.ReadFile(file.name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		existed := err == nil
+		if existed && bytes.Equal(old, file.data) {
+			continue
+		}
+		name, err := patchPath(p.Path(file.name))
+		if err != nil {
+			return err
+		}
+		if err := writePatch(p.w, name, old, file.data, existed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// patchPath returns name relative to the working directory with slashes, as
+// git apply expects it. Files outside the working directory can't be
+// patched.
+func patchPath(name string) (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the working directory, run -patch from a directory containing the bundle", name)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (p patchSource) CachePath() string {
+	return ""
+}
+
+// patchContext is the number of unchanged lines around each change.
+const patchContext = 3
+
+// diffOp is one line of a line diff: kept (' '), removed ('-') or added ('+').
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// writePatch writes the change of the file name from old to new as a unified
+// diff. If the file didn't exist before, it is diffed against /dev/null.
+func writePatch(w io.Writer, name string, old, new []byte, existed bool) error {
+	bw := bufio.NewWriter(w)
+	from := "a/" + name
+	if !existed {
+		from = "/dev/null"
+	}
+	bw.WriteString("--- " + from + "\n+++ b/" + name + "\n")
+
+	ops := diffLines(splitLines(old), splitLines(new))
+	// oldAt and newAt hold the number of old and new lines before each op.
+	oldAt := make([]int, len(ops)+1)
+	newAt := make([]int, len(ops)+1)
+	for i, op := range ops {
+		oldAt[i+1], newAt[i+1] = oldAt[i], newAt[i]
+		if op.kind != '+' {
+			oldAt[i+1]++
+		}
+		if op.kind != '-' {
+			newAt[i+1]++
+		}
+	}
+
+	var hunks [][2]int
+	for i, op := range ops {
+		if op.kind == ' ' {
+			continue
+		}
+		start, end := i-patchContext, i+1+patchContext
+		if start < 0 {
+			start = 0
+		}
+		if end > len(ops) {
+			end = len(ops)
+		}
+		if n := len(hunks); n > 0 && start <= hunks[n-1][1] {
+			hunks[n-1][1] = end
+			continue
+		}
+		hunks = append(hunks, [2]int{start, end})
+	}
+	for _, h := range hunks {
+		bw.WriteString("@@ -" + hunkRange(oldAt[h[0]], oldAt[h[1]]) + " +" + hunkRange(newAt[h[0]], newAt[h[1]]) + " @@\n")
+		for _, op := range ops[h[0]:h[1]] {
+			bw.WriteByte(op.kind)
+			bw.WriteString(op.line)
+			if len(op.line) == 0 || op.line[len(op.line)-1] != '\n' {
+				bw.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// hunkRange formats the lines from start to end, counted from 0, as in a
+// hunk header. An empty range names the line before it.
+func hunkRange(start, end int) string {
+	if start == end {
+		return strconv.Itoa(start) + ",0"
+	}
+	return strconv.Itoa(start+1) + "," + strconv.Itoa(end-start)
+}
+
+// splitLines splits data after every newline.
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n') + 1
+		if i == 0 {
+			i = len(data)
+		}
+		lines = append(lines, string(data[:i]))
+		data = data[i:]
+	}
+	return lines
+}
+
+// diffLines returns a shortest edit script from a to b, using the algorithm
+// of Myers, "An O(ND) Difference Algorithm and Its Variations".
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	v := make([]int, 2*max+3)
+	offset := max + 1
+	// trace[d] holds v[-d-1..d+1] before step d, for walking back.
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrack(a, b []string, trace [][]int) []diffOp {
+	var ops []diffOp
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d+1] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{'+', b[y-1]})
+			} else {
+				ops = append(ops, diffOp{'-', a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
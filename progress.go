@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// progress reports how far hashing got. On a terminal it keeps rewriting a
+// single status line on stderr, otherwise it logs a line every few seconds.
+type progress struct {
+	tty      bool
+	interval time.Duration
+	last     time.Time
+}
+
+func newProgress() *progress {
+	p := &progress{interval: 5 * time.Second}
+	if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		p.tty = true
+		p.interval = 100 * time.Millisecond
+	}
+	return p
+}
+
+// update is a manifest.Options.Progress callback.
+func (p *progress) update(dir string, done, total int) {
+	if done < total && time.Since(p.last) < p.interval {
+		return
+	}
+	p.last = time.Now()
+	if !p.tty {
+		_ = level.Info(logger).Log("message", "hashing", "dir", dir, "done", done, "total", total)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\r\033[K%s: %d/%d", dir, done, total)
+	if done == total {
+		fmt.Fprintln(os.Stderr)
+	}
+}
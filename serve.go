@@ -0,0 +1,102 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/philschleier/apiproxy-manifest/manifest"
+)
+
+// serveMain runs the serve subcommand: an HTTP server that generates the
+// manifest of a zipped bundle posted to /manifest.
+func serveMain(args []string) {
+	fset := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fset.String("addr", ":8080", "`address` to listen on")
+	maxSize := fset.Int64("max-size", 32<<20, "largest accepted upload in `bytes`")
+	hashFlag := fset.String("hash", defaultHash(), hashUsage)
+	fset.Usage = func() {
+		out := fset.Output()
+		fmt.Fprintf(out, "Usage: %s serve [options]\n\n", os.Args[0])
+		fmt.Fprintln(out, "Serves POST /manifest, which takes a zipped bundle as the request body and")
+		fmt.Fprintln(out, "returns its manifest.xml.")
+		fmt.Fprintln(out, "\nOptions:")
+		fset.PrintDefaults()
+	}
+	_ = fset.Parse(args)
+	checkHashEnv(fset)
+	logger = level.NewFilter(logger, level.AllowInfo())
+
+	opts := manifest.Options{Hash: *hashFlag, Logger: logger}
+	if err := opts.Validate(); err != nil {
+		_ = level.Error(logger).Log("message", err)
+		os.Exit(2)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/manifest", manifestHandler{maxSize: *maxSize, opts: opts})
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	_ = level.Info(logger).Log("message", "listening", "addr", *addr)
+	if err := srv.ListenAndServe(); err != nil {
+		_ = level.Error(logger).Log("err", err)
+		os.Exit(1)
+	}
+}
+
+// manifestHandler generates the manifest of the zipped bundle in the request
+// body, which may be at most maxSize bytes.
+type manifestHandler struct {
+	maxSize int64
+	opts    manifest.Options
+}
+
+func (h manifestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, h.maxSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(data)) > h.maxSize {
+		http.Error(w, fmt.Sprintf("bundle larger than %d bytes", h.maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, fsys, err := zipBundle(zr, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	doc, err := manifest.GenerateFSContext(r.Context(), fsys, h.opts)
+	if err != nil {
+		_ = level.Warn(logger).Log("message", "generating manifest", "remote", r.RemoteAddr, "err", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	var buf bytes.Buffer
+	if err := manifest.WriteManifest(doc, &buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_ = level.Info(logger).Log("message", "generated manifest", "remote", r.RemoteAddr, "name", doc.Name)
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
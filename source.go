@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/philschleier/apiproxy-manifest/manifest"
+)
+
+// source is a bundle folder to generate a manifest for, together with the
+// place the results are written back to.
+type source interface {
+	Bundle() (*manifest.Bundle, error)
+	Generate(ctx context.Context, opts manifest.Options) (*manifest.Manifest, error)
+	// ReadFile and Save take slash separated names relative to the bundle
+	// folder.
+	ReadFile(name string) ([]byte, error)
+	Save(files []output) error
+	// Path returns the name of a bundle file as shown to the user, Target
+	// where Save would write it.
+	Path(name string) string
+	Target(name string) string
+	// CachePath returns where digests are cached between runs, or "" if
+	// the source is not cached.
+	CachePath() string
+}
+
+// cacheFile holds the digest cache in the output directory, see
+// folderSource.CachePath.
+const cacheFile = ".manifest-cache.json"
+
+// folderSource is a bundle folder on disk. Results are written back into the
+// folder unless out names a different directory.
+type folderSource struct {
+	folder string
+	out    string
+	logger log.Logger
+}
+
+func (f folderSource) Bundle() (*manifest.Bundle, error) {
+	return manifest.FindBundle(f.folder)
+}
+
+func (f folderSource) Generate(ctx context.Context, opts manifest.Options) (*manifest.Manifest, error) {
+	return manifest.GenerateContext(ctx, f.folder, opts)
+}
+
+func (f folderSource) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(f.Path(name))
+}
+
+func (f folderSource) Save(files []output) error {
+	for _, file := range files {
+		target := f.Target(file.name)
+		if existing, err := ioutil.ReadFile(target); err == nil && bytes.Equal(existing, file.data) {
+			_ = level.Info(f.logger).Log("message", "unchanged "+target)
+			continue
+		}
+		if dir := filepath.Dir(target); !exists(dir) {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+			_ = level.Debug(f.logger).Log("message", "created "+dir)
+		}
+		data := file.data
+		err := writeAtomic(target, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		_ = level.Info(f.logger).Log("message", "wrote "+target)
+	}
+	return nil
+}
+
+func (f folderSource) Path(name string) string {
+	return filepath.Join(f.folder, filepath.FromSlash(name))
+}
+
+func (f folderSource) Target(name string) string {
+	if f.out == "" {
+		return f.Path(name)
+	}
+	return filepath.Join(f.out, filepath.FromSlash(name))
+}
+
+// CachePath returns cacheFile in the output directory, if there is one.
+// Otherwise the cache goes to the user cache directory, named after the
+// absolute bundle folder, so nothing is written into a bundle that may be
+// read-only or deployed as is.
+func (f folderSource) CachePath() string {
+	if f.out != "" {
+		return filepath.Join(f.out, cacheFile)
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	abs, err := filepath.Abs(f.folder)
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "apiproxy-manifest", fmt.Sprintf("%x.json", sha256.Sum256([]byte(abs))))
+}
+
+// exists reports whether name exists.
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// writeAtomic writes name through a temporary file in the same directory that
+// is renamed into place once write succeeded, so name always holds either the
+// old or the complete new content. An existing file keeps its permissions.
+func writeAtomic(name string, write func(io.Writer) error) error {
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(name); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly after the rename
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// pollInterval is how often the watched directories are scanned.
+	pollInterval = 500 * time.Millisecond
+	// settleDelay is how long a bundle must stay unchanged before it is
+	// regenerated, so a burst of saves leads to a single run.
+	settleDelay = 300 * time.Millisecond
+)
+
+// fileState is what a change of a file is detected by.
+type fileState struct {
+	size int64
+	mod  time.Time
+}
+
+// snapshot holds the state of every file below the watched directories of a
+// bundle folder, by path.
+type snapshot map[string]fileState
+
+// watchedDirs returns the directories of the bundle folder whose changes
+// trigger a regeneration with -watch: those Generate hashes with the options
+// of the bundle, its config file included. The manifest and proxy file are
+// written by the tool itself and are not watched.
+func watchedDirs(folder, configPath string, opts options) []string {
+	base, err := loadConfig(folderSource{folder: folder, logger: logger}, configPath)
+	if err != nil {
+		_ = level.Warn(logger).Log("message", "ignoring unreadable config file", "bundle", folder, "err", err)
+	}
+	return withFlags(flag.CommandLine, base, opts.Options).Dirs()
+}
+
+// scan returns the current snapshot of the directories dirs of folder.
+// Missing directories and files removed during the scan are skipped.
+func scan(folder string, dirs []string) snapshot {
+	s := make(snapshot)
+	for _, dir := range dirs {
+		_ = filepath.WalkDir(filepath.Join(folder, filepath.FromSlash(dir)), func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				s[name] = fileState{size: info.Size(), mod: info.ModTime()}
+			}
+			return nil
+		})
+	}
+	return s
+}
+
+func (s snapshot) equal(o snapshot) bool {
+	if len(s) != len(o) {
+		return false
+	}
+	for name, st := range s {
+		if ot, ok := o[name]; !ok || ot.size != st.size || !ot.mod.Equal(st.mod) {
+			return false
+		}
+	}
+	return true
+}
+
+// watch polls the bundle folders of targets and calls regenerate for a target
+// whenever a file in one of its watched directories was added, changed or
+// removed. Errors are logged and watching goes on. It returns when ctx is done.
+func watch(ctx context.Context, targets []string, configPath string, opts options, regenerate func(target string) error) {
+	folders := make([]string, len(targets))
+	dirs := make([][]string, len(targets))
+	last := make([]snapshot, len(targets))
+	for i, target := range targets {
+		folders[i] = bundleFolder(logger, target, opts.dir)
+		dirs[i] = watchedDirs(folders[i], configPath, opts)
+		last[i] = scan(folders[i], dirs[i])
+	}
+	_ = level.Info(logger).Log("message", "watching for changes, press Ctrl-C to stop", "bundles", len(targets))
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for i, target := range targets {
+			cur := scan(folders[i], dirs[i])
+			if cur.equal(last[i]) {
+				continue
+			}
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(settleDelay):
+				}
+				next := scan(folders[i], dirs[i])
+				if next.equal(cur) {
+					break
+				}
+				cur = next
+			}
+			last[i] = cur
+			_ = level.Info(logger).Log("message", "change detected, regenerating", "bundle", target)
+			if err := regenerate(target); err != nil {
+				_ = level.Error(logger).Log("err", err, "bundle", target)
+			}
+		}
+	}
+}
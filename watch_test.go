@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestWatchedDirs checks that -watch polls the directories the config file of
+// a bundle points Generate at, not only the standard ones.
+func TestWatchedDirs(t *testing.T) {
+	files := make(map[string]string)
+	for name, data := range testProxy {
+		files[name] = data
+	}
+	files[configFile] = `{"policiesDir": "src/policies", "resourceRoots": ["shared"]}`
+	files["src/policies/AM-2.xml"] = "<AssignMessage name=\"AM-2\"/>\n"
+	folder := writeBundle(t, files)
+
+	dirs := watchedDirs(folder, "", options{})
+	want := []string{"src/policies", "proxies", "targets", "resources", "sharedflows", "shared"}
+	if !reflect.DeepEqual(dirs, want) {
+		t.Fatalf("watchedDirs = %q, want %q", dirs, want)
+	}
+
+	before := scan(folder, dirs)
+	if _, ok := before[filepath.Join(folder, "src", "policies", "AM-2.xml")]; !ok {
+		t.Errorf("scan missed src/policies/AM-2.xml: %v", before)
+	}
+	if err := ioutil.WriteFile(filepath.Join(folder, "src", "policies", "AM-3.xml"), []byte("<AssignMessage name=\"AM-3\"/>\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if scan(folder, dirs).equal(before) {
+		t.Error("scan didn't notice a policy added under src/policies")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/philschleier/apiproxy-manifest/manifest"
+)
+
+// zipSource is a zipped bundle. The archive itself is left untouched, results
+// are written to a copy named <archive>.manifest.zip next to it, or in out.
+type zipSource struct {
+	*zip.ReadCloser
+	archive string
+	root    string // the bundle directory, see isBundleDir
+	fsys    fs.FS
+	out     string
+	logger  log.Logger
+}
+
+func openZip(archive, out, dir string, logger log.Logger) (*zipSource, error) {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	root, fsys, err := zipBundle(&zr.Reader, dir)
+	if err != nil {
+		zr.Close()
+		return nil, fmt.Errorf("%s: %w", archive, err)
+	}
+	return &zipSource{ReadCloser: zr, archive: archive, root: root, fsys: fsys, out: out, logger: logger}, nil
+}
+
+// zipBundle returns the bundle directory at the root of an archive, as
+// recognized by isBundleDir, and its content.
+func zipBundle(zr *zip.Reader, dir string) (string, fs.FS, error) {
+	entries, _ := fs.ReadDir(zr, ".")
+	for _, e := range entries {
+		if e.IsDir() && isBundleDir(e.Name(), dir) {
+			fsys, err := fs.Sub(zr, e.Name())
+			return e.Name(), fsys, err
+		}
+	}
+	return "", nil, errors.New("no bundle folder in archive")
+}
+
+func (z *zipSource) Bundle() (*manifest.Bundle, error) {
+	return manifest.FindBundleFS(z.fsys)
+}
+
+func (z *zipSource) Generate(ctx context.Context, opts manifest.Options) (*manifest.Manifest, error) {
+	return manifest.GenerateFSContext(ctx, z.fsys, opts)
+}
+
+func (z *zipSource) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(z.fsys, name)
+}
+
+// Save copies every entry of the archive, in order, replacing the content of
+// the given files. Files not yet in the archive are appended.
+func (z *zipSource) Save(files []output) error {
+	replace := make(map[string][]byte)
+	for _, file := range files {
+		replace[path.Join(z.root, file.name)] = file.data
+	}
+
+	target := z.copyName()
+	if z.out != "" {
+		if err := os.MkdirAll(z.out, 0755); err != nil {
+			return err
+		}
+	}
+	err := writeAtomic(target, func(out io.Writer) error {
+		zw := zip.NewWriter(out)
+		for _, f := range z.File {
+			data, ok := replace[f.Name]
+			if !ok {
+				if err := zw.Copy(f); err != nil {
+					return err
+				}
+				continue
+			}
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: f.Modified})
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			delete(replace, f.Name)
+		}
+		added := make([]string, 0, len(replace))
+		for name := range replace {
+			added = append(added, name)
+		}
+		sort.Strings(added)
+		for _, name := range added {
+			w, err := zw.Create(name)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(replace[name]); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	})
+	if err != nil {
+		return err
+	}
+	_ = level.Info(z.logger).Log("message", "wrote "+target)
+	return nil
+}
+
+func (z *zipSource) Path(name string) string {
+	return z.archive + ":" + path.Join(z.root, name)
+}
+
+func (z *zipSource) Target(name string) string {
+	return z.copyName() + ":" + path.Join(z.root, name)
+}
+
+func (z *zipSource) copyName() string {
+	target := strings.TrimSuffix(z.archive, ".zip") + ".manifest.zip"
+	if z.out != "" {
+		target = filepath.Join(z.out, filepath.Base(target))
+	}
+	return target
+}
+
+// CachePath returns "" since the archive is rewritten as a whole anyway.
+func (z *zipSource) CachePath() string {
+	return ""
+}